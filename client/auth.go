@@ -0,0 +1,45 @@
+package client
+
+import (
+	"fmt"
+
+	"go-sockets/protocol"
+)
+
+// authenticate answers the server's challenge with the socket's
+// credentials, or with none if it has no credentials configured, and waits
+// for the verdict. A rejection is reported as a *protocol.AuthError.
+func (sess *session) authenticate(credentials func(challenge []byte) *protocol.Credentials) error {
+	frame, err := sess.decoder.Decode()
+	if err != nil {
+		return err
+	}
+	if frame.Type != protocol.FRAME_TYPE_AUTH {
+		return fmt.Errorf("Expected auth challenge, got frame type %v", frame.Type)
+	}
+
+	creds := &protocol.Credentials{Method: protocol.AUTH_NONE}
+	if credentials != nil {
+		creds = credentials(frame.Payload)
+	}
+	if err := sess.writeDirect(protocol.FRAME_TYPE_AUTH, creds.Bytes()); err != nil {
+		return err
+	}
+
+	frame, err = sess.decoder.Decode()
+	if err != nil {
+		return err
+	}
+	switch frame.Type {
+	case protocol.FRAME_TYPE_AUTH:
+		return nil
+	case protocol.FRAME_TYPE_CLOSE:
+		reason, err := protocol.DecodeCloseReason(frame.Payload)
+		if err != nil {
+			return err
+		}
+		return &protocol.AuthError{Reason: reason.Reason}
+	default:
+		return fmt.Errorf("Expected auth result, got frame type %v", frame.Type)
+	}
+}
@@ -1,26 +1,21 @@
 package client
 
 import (
-	"bufio"
-	"encoding/binary"
+	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
-)
-
-type FrameType byte
 
-const (
-	// MAX_BUFFERED_BYTES       uint64    = 1024 * 512
-	FRAME_SIZE               int       = 4096
-	FRAME_TYPE_MESSAGE       FrameType = 90
-	FRAME_TYPE_HEARTBEAT     FrameType = 91
-	FRAME_TYPE_HEARTBEAT_ACK FrameType = 92
-	FRAME_TYPE_READY         FrameType = 93
+	"go-sockets/codec"
+	"go-sockets/compress"
+	"go-sockets/protocol"
 )
 
 const (
@@ -28,517 +23,701 @@ const (
 )
 
 type ConnectionHandler func(socket *Socket)
-type MessageHandler func(data string)
-
-type BuffQueue struct {
-	currentIndex int
-	queue        [][]byte
-	mutex        sync.RWMutex
+type DisconnectionHandler func(reason *protocol.CloseReason)
+type MessageHandler = protocol.MessageHandler
+type RequestHandler = protocol.RequestHandler
+type AnyHandler = protocol.AnyHandler
+type Subscription = protocol.Subscription
+
+// session is the state of a single connection. Reconnecting replaces it as
+// a whole, so goroutines serving an old connection never touch a new one.
+type session struct {
+	connection  net.Conn
+	encoder     *protocol.Encoder
+	decoder     *protocol.Decoder
+	handshake   *protocol.Handshake
+	queue       *protocol.SendQueue
+	pending     *protocol.Pending
+	transfers   *protocol.Streams
+	keepalive   *protocol.Keepalive
+	compression *protocol.Compression
+	activity    *protocol.Activity
+	stalled     atomic.Bool
+	done        chan struct{}
+	// closeReason is what the server sent in its close frame, if it sent
+	// one.
+	closeReason *protocol.CloseReason
+}
+
+// Socket is a connection to a server that reconnects as configured. Its
+// handlers for the server's events, requests and streams are registered
+// through the embedded protocol.Listeners and outlive reconnects.
+type Socket struct {
+	protocol.Listeners
+	Id                  string
+	address             string
+	session             *session
+	mutex               sync.RWMutex
+	middleware          []Middleware
+	middlewareMutex     sync.RWMutex
+	connected           atomic.Bool
+	highWaterMark       int
+	overflowPolicy      protocol.OverflowPolicy
+	dispatchMode        protocol.DispatchMode
+	heartbeatInterval   time.Duration
+	maxMissedHeartbeats int
+	frameSize           int
+	maxMessageSize      int
+	eventSizeLimits     map[string]int
+	compressors         []compress.Compressor
+	minCompressSize     int
+	idleTimeout         time.Duration
+	readTimeout         time.Duration
+	writeTimeout        time.Duration
+	dialTimeout         time.Duration
+	requestTimeout      time.Duration
+	logger              *log.Logger
+	dispatcher          *protocol.Dispatcher
+	reconnectPolicy     *ReconnectPolicy
+	tlsConfig           *tls.Config
+	credentials         func(challenge []byte) *protocol.Credentials
+	errorEvent          ErrorHandler
+	disconnectEvent     DisconnectionHandler
+	codecs              *codec.Registry
+	closing             chan struct{}
+	closeOnce           sync.Once
+	// bytesSent        uint64
 }
 
-func (q *BuffQueue) len() int {
-	return len(q.queue)
+// Start connects and returns, serving the connection in the background.
+// If reconnecting fails for good, the error is passed to handlers for
+// "reconnect_failed" and to OnError.
+func (s *Socket) Start() error {
+	err := s.connect()
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := s.run(); err != nil {
+			s.reportError(err)
+		}
+	}()
+	return nil
 }
 
-func (q *BuffQueue) next() []byte {
-	if q.currentIndex == q.len() {
-		return nil
+func (s *Socket) Listen() error {
+	err := s.connect()
+	if err != nil {
+		return err
 	}
-	q.mutex.RLock()
-	defer q.mutex.RUnlock()
-	buff := q.queue[q.currentIndex]
-	q.currentIndex++
-	return buff
+	return s.run()
 }
 
-func (q *BuffQueue) append(buff []byte) {
-	q.mutex.Lock()
-	defer q.mutex.Unlock()
-	q.queue = append(q.queue, buff)
+func (s *Socket) run() error {
+	for {
+		sess := s.current()
+		go s.write(sess)
+		go s.startHeartbeat(sess)
+		s.envokeEvent("connection", "")
+		s.listen(sess)
+
+		if s.reconnectPolicy == nil || s.isClosing() {
+			return nil
+		}
+		if err := s.reconnect(); err != nil {
+			s.envokeEvent("reconnect_failed", err.Error())
+			return err
+		}
+		if s.isClosing() {
+			return nil
+		}
+	}
 }
 
-type RoundRobinBuffer struct {
-	queue sync.Map
-}
+func (s *Socket) reconnect() error {
+	var err error
+	for attempt := 1; s.reconnectPolicy.MaxAttempts == 0 || attempt <= s.reconnectPolicy.MaxAttempts; attempt++ {
+		s.envokeEvent("reconnecting", strconv.Itoa(attempt))
 
-func (rrb *RoundRobinBuffer) append(seq int, buff []byte) {
-	// rrb.mutex.Lock()
-	// defer rrb.mutex.Unlock()
+		select {
+		case <-time.After(s.reconnectPolicy.delay(attempt)):
+		case <-s.closing:
+			return nil
+		}
 
-	q, _ := rrb.queue.LoadOrStore(seq, &BuffQueue{})
+		if err = s.connect(); err == nil {
+			s.envokeEvent("reconnected", strconv.Itoa(attempt))
+			return nil
+		}
+		if s.isClosing() {
+			return nil
+		}
 
-	if q != nil {
-		if q, ok := q.(*BuffQueue); ok {
-			q.append(buff)
+		// retrying cannot fix rejected credentials or a handshake the
+		// server refused
+		var authErr *protocol.AuthError
+		var refusal *protocol.CloseReason
+		if errors.As(err, &authErr) || errors.As(err, &refusal) {
+			return err
 		}
 	}
+	return fmt.Errorf("Giving up after %v reconnection attempts: %v", s.reconnectPolicy.MaxAttempts, err)
 }
 
-func (rrb *RoundRobinBuffer) clean(seq int) {
-	// rrb.mutex.Lock()
-	// defer rrb.mutex.Unlock()
-	// delete(rrb.queue, seq)
-	rrb.queue.Store(seq, nil)
+func (s *Socket) isClosing() bool {
+	select {
+	case <-s.closing:
+		return true
+	default:
+		return false
+	}
 }
 
-func (rrb *RoundRobinBuffer) clear() {
-	// rrb.mutex.Lock()
-	// defer rrb.mutex.Unlock()
-	// delete(rrb.queue, seq)
-	rrb.queue.Range(func(key, val interface{}) bool {
-		if val == nil {
-			log.Println(key, val)
-			rrb.queue.Delete(key)
-		}
-		return true
+// Request sends data on event and waits for the peer's reply. If ctx has no
+// deadline, the socket's request timeout applies. A handler failing on
+// the peer's side is reported as a *protocol.RemoteError.
+func (s *Socket) Request(ctx context.Context, event string, data []byte) ([]byte, error) {
+	if !s.Supports(protocol.FEATURE_ACKS) {
+		return nil, protocol.ErrAcksNotSupported
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.requestTimeout)
+		defer cancel()
+	}
+
+	// the reply can only come back on the connection the request went out
+	// on, as request ids are not unique across connections
+	sess := s.current()
+	if sess == nil {
+		return nil, protocol.ErrConnectionClosed
+	}
+	return sess.pending.Do(ctx, event, data, func(payload []byte) error {
+		return sess.compressed(protocol.FRAME_TYPE_REQUEST, payload)
 	})
 }
 
-func NewRoundRobinBuffer() *RoundRobinBuffer {
-	return &RoundRobinBuffer{}
+// RegisterCodec makes c available for decoding typed events and, if
+// makeDefault is set, uses it to encode them.
+func (s *Socket) RegisterCodec(c codec.Codec, makeDefault bool) error {
+	if err := s.codecs.Register(c); err != nil {
+		return err
+	}
+	if makeDefault {
+		return s.codecs.SetDefault(c.Id())
+	}
+	return nil
 }
 
-type Sequencer struct {
-	current        int64
-	UpperBoundBits uint
-	mutex          sync.Mutex
+func (s *Socket) Connection() net.Conn {
+	if sess := s.current(); sess != nil {
+		return sess.connection
+	}
+	return nil
 }
 
-func (seq *Sequencer) Next() int64 {
-	seq.mutex.Lock()
-	defer seq.mutex.Unlock()
-	if seq.current == 1<<seq.UpperBoundBits-1 {
-		seq.current = 0
+// Latency is the round trip time of the last heartbeat the server
+// answered.
+func (s *Socket) Latency() time.Duration {
+	sess := s.current()
+	if sess == nil {
+		return 0
 	}
-
-	next := seq.current
-	seq.current++
-	return next
+	return sess.keepalive.Latency()
 }
 
-func (seq *Sequencer) Val() int64 {
-	if seq.current == 0 {
-		return seq.current
-	}
-	return seq.current - 1
+// Supports reports whether feature was accepted during the handshake.
+func (s *Socket) Supports(feature uint32) bool {
+	sess := s.current()
+	return sess != nil && sess.handshake.Has(feature)
 }
 
-type Socket struct {
-	Id               string
-	address          string
-	connection       net.Conn
-	events           map[string]MessageHandler
-	connected        bool
-	lastHeartbeatAck int64
-	sequence         *Sequencer
-	buffer           *RoundRobinBuffer
-	// bytesSent        uint64
+func (s *Socket) current() *session {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.session
 }
 
-func (s *Socket) Start() error {
-	err := s.connect()
+func (s *Socket) connect() error {
+	dialer := &net.Dialer{Timeout: s.dialTimeout}
+	var conn net.Conn
+	var err error
+	if s.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.address, s.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", s.address)
+	}
 	if err != nil {
 		return err
 	}
-	s.envokeEvent("connection", "")
-	go s.listen()
+
+	sess := &session{
+		connection: conn,
+		encoder:    protocol.NewEncoder(s.frameSize),
+		decoder:    protocol.NewDecoder(conn),
+		queue:      protocol.NewSendQueue(s.highWaterMark, s.overflowPolicy),
+		pending:    protocol.NewPending(),
+		activity:   protocol.NewActivity(),
+		done:       make(chan struct{}),
+	}
+	sess.transfers = protocol.NewStreams(func(payload []byte) error {
+		return sess.send(protocol.FRAME_TYPE_STREAM, payload)
+	})
+	sess.encoder.Activity = sess.activity
+	sess.decoder.Activity = sess.activity
+	sess.decoder.Ordered = s.dispatchMode != protocol.DISPATCH_CONCURRENT
+	sess.decoder.MaxFrameSize = s.frameSize
+	sess.decoder.MaxMessageSize = s.maxMessageSize
+	sess.decoder.MaxBuffered = protocol.MAX_BUFFERED_MESSAGES * s.maxMessageSize
+	sess.decoder.EventSizeLimits = s.eventSizeLimits
+	conn.SetDeadline(time.Now().Add(protocol.HANDSHAKE_TIMEOUT))
+	if err := sess.offerHandshake(s.frameSize, s.heartbeatInterval, s.maxMissedHeartbeats, s.compressors); err != nil {
+		conn.Close()
+		return fmt.Errorf("Handshake failed: %w", err)
+	}
+	sess.compression = protocol.NewCompression(sess.handshake, s.compressors, s.minCompressSize, s.maxMessageSize)
+	if sess.handshake.Has(protocol.FEATURE_AUTH) {
+		if err := sess.authenticate(s.credentials); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	sess.activity.Touch()
+	sess.decoder.IdleTimeout = s.idleTimeout
+	sess.decoder.ReadTimeout = s.readTimeout
+
+	// Disconnect closes whatever session it finds after marking the socket
+	// as closing, so one connected after that must not be published
+	s.mutex.Lock()
+	if s.isClosing() {
+		s.mutex.Unlock()
+		conn.Close()
+		return protocol.ErrConnectionClosed
+	}
+	s.session = sess
+	s.connected.Store(true)
+	s.mutex.Unlock()
 	return nil
 }
 
-func (s *Socket) Listen() error {
-	err := s.connect()
+func (sess *session) offerHandshake(frameSize int, heartbeatInterval time.Duration, maxMissed int, compressors []compress.Compressor) error {
+	offer := protocol.NewHandshake(frameSize, heartbeatInterval, protocol.CompressorIds(compressors))
+	if err := sess.writeDirect(protocol.FRAME_TYPE_READY, offer.Bytes()); err != nil {
+		return err
+	}
+
+	frame, err := sess.decoder.Decode()
+	if err != nil {
+		return err
+	}
+	if frame.Type == protocol.FRAME_TYPE_CLOSE {
+		return refused(frame.Payload)
+	}
+	if frame.Type != protocol.FRAME_TYPE_READY {
+		return fmt.Errorf("Expected handshake frame, got frame type %v", frame.Type)
+	}
+
+	accepted, err := protocol.DecodeHandshake(frame.Payload)
 	if err != nil {
 		return err
 	}
-	s.envokeEvent("connection", "")
-	go s.processSendQueue()
-	go s.startHeartbeat()
-	s.listen()
+	if accepted.Version > offer.Version || accepted.Features&^offer.Features != 0 ||
+		accepted.MaxFrameSize < uint32(protocol.MIN_FRAME_SIZE) || accepted.MaxFrameSize > offer.MaxFrameSize ||
+		accepted.Has(protocol.FEATURE_COMPRESSION) && (len(accepted.Compressors) != 1 || bytes.IndexByte(offer.Compressors, accepted.Compressors[0]) < 0) {
+		return fmt.Errorf("Server accepted a handshake that was not offered: %+v", accepted)
+	}
+
+	sess.handshake = accepted
+	sess.transfers.Flow = accepted.Has(protocol.FEATURE_STREAM_FLOW)
+	sess.encoder.FrameSize = int(accepted.MaxFrameSize)
+	sess.decoder.MaxFrameSize = int(accepted.MaxFrameSize)
+	if accepted.HeartbeatInterval != 0 {
+		heartbeatInterval = time.Duration(accepted.HeartbeatInterval) * time.Millisecond
+	}
+	sess.keepalive = protocol.NewKeepalive(heartbeatInterval, maxMissed)
 	return nil
 }
 
-func (s *Socket) On(event string, callback MessageHandler) {
-	s.events[event] = callback
+// refused returns the reason in a close frame the server sent instead of
+// accepting the handshake.
+func refused(payload []byte) error {
+	reason, err := protocol.DecodeCloseReason(payload)
+	if err != nil {
+		return err
+	}
+	return reason
 }
 
-func (s *Socket) Off(event string) {
-	if _, ok := s.events[event]; ok {
-		delete(s.events, event)
-	}
+// send queues a control frame, such as a heartbeat or a close frame, on
+// sess. It goes through whatever the overflow policy.
+func (sess *session) send(frameType protocol.FrameType, data []byte) error {
+	seq, frames := sess.encoder.Encode(frameType, data)
+	return sess.queue.PushControl(&protocol.Outgoing{Seq: seq, Frames: frames})
 }
 
-func (s *Socket) Connection() net.Conn {
-	return s.connection
+// ack answers a heartbeat unless the send queue is full. A server that
+// does not read its acknowledgements misses a latency sample instead of
+// growing the queue.
+func (sess *session) ack(payload []byte) {
+	seq, frames := sess.encoder.Encode(protocol.FRAME_TYPE_HEARTBEAT_ACK, payload)
+	sess.queue.Offer(&protocol.Outgoing{Seq: seq, Frames: frames})
 }
 
-func (s *Socket) connect() error {
-	conn, err := net.Dial("tcp", s.address)
-	if err != nil {
-		return err
+// writeDirect writes a frame straight to the connection, for the exchanges
+// that happen before the send queue is running.
+func (sess *session) writeDirect(frameType protocol.FrameType, data []byte) error {
+	_, frames := sess.encoder.Encode(frameType, data)
+	for _, frame := range frames {
+		if _, err := sess.connection.Write(frame); err != nil {
+			return err
+		}
 	}
-	s.connection = conn
-	s.buffer = NewRoundRobinBuffer()
 	return nil
 }
 
-func (s *Socket) disconnect() {
-	if !s.connected {
-		s.connection.Close()
-		return
+// OnDisconnection sets the handler that runs whenever the connection ends,
+// with the reason it did. Handlers registered for "disconnection" with On
+// run as well and get the reason as text.
+func (s *Socket) OnDisconnection(handler DisconnectionHandler) {
+	s.disconnectEvent = handler
+}
+
+// close sends a close frame carrying reason, gives the writer a moment to
+// put it on the wire and then closes sess. It returns reason.
+func (s *Socket) close(sess *session, reason *protocol.CloseReason) *protocol.CloseReason {
+	if sess.send(protocol.FRAME_TYPE_CLOSE, reason.Bytes()) == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), CLOSE_FLUSH_TIMEOUT)
+		sess.queue.Flush(ctx)
+		cancel()
 	}
-	s.connected = false
-	s.connection.Close()
-	s.envokeEvent("disconnection", "")
+	s.closeSession(sess, reason)
+	return reason
 }
 
-func (s *Socket) envokeEvent(name, data string) {
-	if handler, ok := s.events[name]; ok {
-		handler(data)
+// closeSession tears sess down, firing the disconnection handlers with
+// reason only if sess is still the live connection.
+func (s *Socket) closeSession(sess *session, reason *protocol.CloseReason) {
+	s.mutex.Lock()
+	if sess != s.session || !s.connected.CompareAndSwap(true, false) {
+		s.mutex.Unlock()
+		sess.connection.Close()
+		return
+	}
+	s.mutex.Unlock()
+
+	sess.queue.Close()
+	sess.connection.Close()
+	close(sess.done)
+	sess.pending.Close()
+	sess.transfers.Close()
+	if err := guard("disconnection", func() error {
+		s.disconnectEvent(reason)
+		return nil
+	}); err != nil {
+		s.reportError(err)
 	}
+	s.envokeEvent("disconnection", reason.Error())
 }
 
-func (s *Socket) processSendQueue() {
-	// go func() {
-	// 	for {
-	// 		time.Sleep(time.Second * 5)
-	// 		log.Println(s.bytesSent)
-	// 	}
-	// }()
-	// var printLock sync.Mutex
-	for {
-		if !s.connected {
-			break
+// envokeEvent fires a local event such as "connection". Only handlers
+// registered for exactly that name see it, not patterns or OnAny.
+func (s *Socket) envokeEvent(name, data string) {
+	for _, handler := range s.Handlers(name) {
+		if err := guard(name, func() error {
+			handler(&protocol.Message{Event: name, Data: []byte(data)})
+			return nil
+		}); err != nil {
+			s.reportError(err)
 		}
+	}
+}
 
-		// if s.bytesSent >= MAX_BUFFERED_BYTES {
-		// 	time.Sleep(time.Millisecond)
-		// 	continue
-		// }
-
-		s.buffer.queue.Range(func(i, queue interface{}) bool {
-			if queue != nil {
-				if queue, ok := queue.(*BuffQueue); ok {
-					if frame := queue.next(); frame != nil {
-						rawBytes(s, frame)
-					} else {
-						if i, iok := i.(int); iok {
-							s.buffer.clean(i)
-						}
-						return true
-					}
-				}
-			}
-
-			time.Sleep(time.Millisecond * 1)
-
-			return true
-		})
-
-		// s.buffer.clear()
-
-		// printLock.Lock()
-		// log.Println(s.buffer.queue)
-		// printLock.Unlock()
-
-		// time.Sleep(time.Second * 1)
-
-		// ks := s.buffer.keys()
-		// log.Println("keys", ks)
-		// for key := range ks {
-		// 	if queue, ok := s.buffer.queue[key]; ok {
-		// 		log.Println("queue ok", ok)
-		// 		if frame := queue.next(); frame != nil {
-		// 			log.Println("frame head", frame[:6])
-		// 			rawBytes(s, frame)
-		// 		} else {
-		// 			s.buffer.clean(key)
-		// 		}
-		// 	}
-
-		// 	// time.Sleep(time.Second * 1)
-		// 	// ks = s.buffer.keys()
-		// }
+// write drains the send queue of sess. If a write fails it stops queueing
+// but leaves closing sess to the reader, which may still find the server's
+// close frame on the connection, or to the next heartbeat. The
+// connection to a server that stopped reading is closed right away.
+func (s *Socket) write(sess *session) {
+	err := sess.queue.Run(&protocol.DeadlineWriter{Conn: sess.connection, Timeout: s.writeTimeout})
+	if err == nil {
+		return
+	}
 
+	s.logger.Println("write err", err)
+	if errors.Is(err, protocol.ErrWriteTimeout) {
+		sess.stalled.Store(true)
+		sess.queue.Close()
+		sess.connection.Close()
+		return
 	}
+	sess.queue.Close()
 }
 
-func (s *Socket) startHeartbeat() {
-	// time.Sleep(time.Second * 2)
-	for {
-		if !s.connected {
-			break
-		}
-
-		start := time.Now().UnixNano() / 1000000
-		// log.Println("sending heartbeat", start)
-		raw(s, []byte{}, FRAME_TYPE_HEARTBEAT)
-		time.Sleep(time.Second * HEARTBEAT_INTERVAL)
-		if !s.connected {
-			break
-		}
-		if s.lastHeartbeatAck == 0 || s.lastHeartbeatAck-start > HEARTBEAT_INTERVAL*1000 {
-			// log.Println("disconnecting from server")
-			// break
-		}
-		// log.Println("HEARTBEAT OK")
+// startHeartbeat keeps sending heartbeats until sess closes, closing it
+// with protocol.CLOSE_TIMEOUT if the server goes silent or as lost once
+// heartbeats can no longer be sent.
+func (s *Socket) startHeartbeat(sess *session) {
+	err := sess.keepalive.Run(sess.done, func(payload []byte) error {
+		return sess.send(protocol.FRAME_TYPE_HEARTBEAT, payload)
+	})
+	switch {
+	case err == nil:
+	case errors.Is(err, protocol.ErrHeartbeatTimeout):
+		s.closeSession(sess, protocol.NewCloseReason(protocol.CLOSE_TIMEOUT, err.Error()))
+	case sess.stalled.Load():
+		s.closeSession(sess, protocol.NewCloseReason(protocol.CLOSE_WRITE_TIMEOUT, protocol.ErrWriteTimeout.Error()))
+	default:
+		s.closeSession(sess, protocol.NewCloseReason(protocol.CLOSE_CONNECTION_LOST, err.Error()))
 	}
-	s.disconnect()
 }
 
-func (s *Socket) listen() {
-	sockBuffer := bufio.NewReader(s.connection)
+func (s *Socket) listen(sess *session) {
+	s.closeSession(sess, s.serve(sess))
+}
 
+// serve handles incoming frames until the connection ends and returns why
+// it did.
+func (s *Socket) serve(sess *session) *protocol.CloseReason {
 	for {
-		if !s.connected {
-			break
+		frame, err := sess.decoder.Decode()
+		if errors.Is(err, protocol.ErrMessageTooLarge) || errors.Is(err, protocol.ErrFrameTooLarge) || errors.Is(err, protocol.ErrBufferFull) {
+			return s.oversize(sess, err)
 		}
-
-		size := make([]byte, 4)
-		n, err := sockBuffer.Read(size)
-		if err != nil || n != 4 {
-			// log.Println("err", err, n)
-			break
+		if errors.Is(err, protocol.ErrIdleTimeout) {
+			return s.close(sess, protocol.NewCloseReason(protocol.CLOSE_IDLE_TIMEOUT, err.Error()))
 		}
-
-		sizeVal := int(binary.BigEndian.Uint32(size))
-
-		payload := make([]byte, sizeVal)
-		n, err = io.ReadFull(sockBuffer, payload)
-		if err != nil || n != sizeVal {
-			// log.Println("err2", err, n, len(payload))
-			break
+		if errors.Is(err, protocol.ErrReadTimeout) {
+			return s.close(sess, protocol.NewCloseReason(protocol.CLOSE_READ_TIMEOUT, err.Error()))
+		}
+		if err != nil && sess.stalled.Load() {
+			return protocol.NewCloseReason(protocol.CLOSE_WRITE_TIMEOUT, protocol.ErrWriteTimeout.Error())
+		}
+		if err != nil {
+			if sess.closeReason != nil {
+				return sess.closeReason
+			}
+			return protocol.NewCloseReason(protocol.CLOSE_CONNECTION_LOST, err.Error())
 		}
+		sess.keepalive.Seen()
 
-		frameType := payload[0]
+		if frame.Compressed() {
+			frame.Payload, err = sess.compression.Decompress(frame.Payload)
+			if err == nil {
+				err = sess.decoder.CheckEventSize(frame)
+			}
+			if errors.Is(err, protocol.ErrMessageTooLarge) {
+				return s.oversize(sess, err)
+			}
+			if err != nil {
+				return s.fail(sess, &protocol.ProtocolError{Err: err})
+			}
+		}
 
-		switch frameType {
-		case byte(FRAME_TYPE_MESSAGE):
-			processMessageFrame(s, payload[1:])
-		case byte(FRAME_TYPE_HEARTBEAT):
-			raw(s, []byte{}, FRAME_TYPE_HEARTBEAT_ACK)
-		case byte(FRAME_TYPE_HEARTBEAT_ACK):
-			s.lastHeartbeatAck = time.Now().UnixNano() / 1000000
+		switch frame.Type {
+		case protocol.FRAME_TYPE_MESSAGE:
+			err = processMessageFrame(s, frame.Payload)
+		case protocol.FRAME_TYPE_REQUEST:
+			err = processRequestFrame(s, sess, frame.Payload)
+		case protocol.FRAME_TYPE_STREAM:
+			err = processStreamFrame(s, sess, frame.Payload)
+		case protocol.FRAME_TYPE_RESPONSE:
+			var res *protocol.Response
+			if res, err = protocol.DecodeResponse(frame.Payload); err == nil {
+				sess.pending.Resolve(res)
+			}
+		case protocol.FRAME_TYPE_HEARTBEAT:
+			if err = protocol.CheckHeartbeat(frame.Payload); err == nil {
+				sess.ack(frame.Payload)
+			}
+		case protocol.FRAME_TYPE_HEARTBEAT_ACK:
+			sess.keepalive.Ack(frame.Payload)
+		case protocol.FRAME_TYPE_READY:
+			s.logger.Println("ignoring repeated handshake")
+		case protocol.FRAME_TYPE_CLOSE:
+			// the server is going away; keep reading until it hangs up so
+			// replies from its in-flight handlers still arrive
+			sess.closeReason, err = protocol.DecodeCloseReason(frame.Payload)
 		default:
-			log.Fatalln("unknown frame type", frameType, payload)
+			err = fmt.Errorf("Unknown frame type %v", frame.Type)
 		}
+		if err != nil {
+			return s.fail(sess, &protocol.ProtocolError{Err: err})
+		}
+	}
+}
+
+func processMessageFrame(s *Socket, payload []byte) error {
+	msg, err := protocol.DecodeMessage(payload)
+	if err != nil {
+		return err
 	}
-	s.disconnect()
+
+	s.dispatcher.Dispatch(msg.Event, func() {
+		s.handleMessage(msg)
+	})
+	return nil
 }
 
-func processMessageFrame(s *Socket, frame []byte) {
-	frameLen := len(frame)
-	if frameLen > 3 {
-		eventLen := binary.BigEndian.Uint16(frame[:2])
-		eventEnd := int(2 + eventLen)
-		eventName := string(frame[2:eventEnd])
+func processRequestFrame(s *Socket, sess *session, payload []byte) error {
+	id, msg, err := protocol.DecodeRequest(payload)
+	if err != nil {
+		return err
+	}
 
-		data := frame[eventEnd:]
+	s.dispatcher.Dispatch(msg.Event, func() {
+		s.envokeRequest(sess, id, msg)
+	})
+	return nil
+}
+
+// envokeRequest runs the handler for a request that arrived on sess and
+// sends the reply back on sess. A reply for a connection that has gone
+// away is dropped; the server has already failed the request.
+func (s *Socket) envokeRequest(sess *session, id uint32, msg *protocol.Message) {
+	var reply []byte
+	handled := false
+	err := guard(msg.Event, func() error {
+		return s.chain(func(socket *Socket, msg *protocol.Message) error {
+			handled = true
+
+			var err error
+			reply, err = socket.HandleRequest(msg)
+			return err
+		})(s, msg)
+	})
+	var panicErr *protocol.PanicError
+	if errors.As(err, &panicErr) {
+		s.reportError(err)
+		err = errors.New("Request handler for event " + msg.Event + " panicked")
+	}
+	if err == nil && !handled {
+		err = errors.New("Request for event " + msg.Event + " was not handled")
+	}
 
-		go s.envokeEvent(eventName, string(data))
+	res := protocol.NewResponse(id, reply, err)
+	if err := sess.compressed(protocol.FRAME_TYPE_RESPONSE, res.Bytes()); err != nil && !errors.Is(err, protocol.ErrConnectionClosed) {
+		s.reportError(fmt.Errorf("Couldn't reply to request for event %v: %w", msg.Event, err))
 	}
 }
 
 func (s *Socket) Connected() bool {
-	return s.connected
+	return s.connected.Load()
 }
 
+// Disconnect closes the connection for good; a socket with reconnection
+// enabled does not try to reconnect afterwards.
 func (s *Socket) Disconnect() {
-	s.disconnect()
+	s.closeOnce.Do(func() {
+		close(s.closing)
+	})
+	if sess := s.current(); sess != nil {
+		s.close(sess, protocol.NewCloseReason(protocol.CLOSE_NORMAL, ""))
+	}
 }
 
-// Under development. Does not guarantee 100% synchronization
-func (s *Socket) SendSync(event, data string) {
-	send(s, event, data)
+// SendSync is the same as Send.
+//
+// Deprecated: Send no longer hands every message to a goroutine of its
+// own, so SendSync has nothing left to do differently. Use Send.
+func (s *Socket) SendSync(event, data string) error {
+	return send(s, event, data)
 }
 
-func (s *Socket) Send(event, data string) {
-	go send(s, event, data)
+// Send queues data for writing. When the send queue is past its high-water
+// mark it blocks, drops older messages or fails with protocol.ErrQueueFull,
+// depending on the socket's overflow policy.
+func (s *Socket) Send(event, data string) error {
+	return send(s, event, data)
 }
 
-func (s *Socket) Emit(event string, data []byte) {
-	go emit(s, event, data)
+// Emit is Send for binary data.
+func (s *Socket) Emit(event string, data []byte) error {
+	return emit(s, codec.CODEC_RAW, event, data)
 }
 
-// Under development. Does not guarantee 100% synchronization
-func (s *Socket) EmitSync(event string, data []byte) {
-	emit(s, event, data)
+// EmitSync is the same as Emit.
+//
+// Deprecated: Emit no longer hands every message to a goroutine of its
+// own, so EmitSync has nothing left to do differently. Use Emit.
+func (s *Socket) EmitSync(event string, data []byte) error {
+	return emit(s, codec.CODEC_RAW, event, data)
 }
 
-func emit(socket *Socket, event string, data []byte) error {
-	if !socket.connected {
-		return errors.New("Connection is already closed")
-	}
-
-	if len(event) > 1<<16-2 {
-		return fmt.Errorf("Event Name length exceeds the maximum of %v bytes\n", 1<<16-2)
+func emit(socket *Socket, codecId byte, event string, data []byte) error {
+	payload, err := protocol.EncodeMessage(codecId, event, data)
+	if err != nil {
+		return err
 	}
 
-	bufferedBytes := 0
-	eventBytes := []byte(event)
-	eventLen := len(eventBytes)
-	payload := []byte{0, 0}
-
-	binary.BigEndian.PutUint16(payload, uint16(eventLen))
-	payload = append(payload, eventBytes...)
-	payload = append(payload, data...)
-
-	dataLen := len(payload)
-
-	// log.Println("emit sending", dataLen, "bytes")
-
-	header := []byte{0, 0, 0, 0, 0, byte(FRAME_TYPE_MESSAGE)}
-
-	seq := uint16(socket.sequence.Next())
-	binary.BigEndian.PutUint16(header[2:4], seq)
-
-	headerLen := len(header)
-	usable := FRAME_SIZE - headerLen
-
-	for bufferedBytes < dataLen {
-		frameEnd := bufferedBytes + (usable)
-		if frameEnd > dataLen {
-			frameEnd = bufferedBytes + (dataLen - bufferedBytes)
-		}
-		dataSlice := payload[bufferedBytes:frameEnd]
-		sliceLen := len(dataSlice)
-
-		binary.BigEndian.PutUint16(header, uint16(sliceLen))
-
-		buff := []byte{}
-
-		buff = append(buff, header...)
-		buff = append(buff, dataSlice...)
-
-		bufferedBytes += sliceLen
-
-		if bufferedBytes == dataLen {
-			buff[4] = 2
-		} else if bufferedBytes != 0 {
-			header[4] = 1
-		}
-
-		// log.Println("buff", buff)
+	return compressed(socket, payload, protocol.FRAME_TYPE_MESSAGE)
+}
 
-		socket.buffer.append(int(seq), buff)
-		time.Sleep(time.Microsecond * 500)
+// compressed is raw for payloads that are worth compressing, if the
+// handshake settled on a compressor.
+func compressed(socket *Socket, data []byte, frameType protocol.FrameType) error {
+	sess := socket.current()
+	if sess == nil || !socket.connected.Load() {
+		return protocol.ErrConnectionClosed
 	}
-
-	// log.Println("finished sending", dataLen, "bytes")
-
-	// headerBuff := []byte{0, 0, 0, 0}
-
-	// payload := []byte{0, 0}
-
-	// eventBytes := []byte(event)
-	// eventLen := len(eventBytes)
-	// binary.BigEndian.PutUint16(payload, uint16(eventLen))
-
-	// payload = append(payload, eventBytes...)
-	// payload = append(payload, data...)
-
-	// binary.BigEndian.PutUint32(headerBuff, uint32(len(payload)+1))
-	// headerBuff = append(headerBuff, byte(FRAME_TYPE_MESSAGE))
-
-	// frameBuff := []byte{}
-	// frameBuff = append(frameBuff, headerBuff...)
-	// frameBuff = append(frameBuff, payload...)
-
-	// time.Sleep(time.Microsecond * 500)
-	// fmt.Println("writing", len(frameBuff), "bytes")
-	// if _, err := socket.connection.Write(frameBuff); err != nil {
-	// 	return fmt.Errorf("Error writing to underlying connection: %v", err)
-	// }
-	return nil
+	return sess.compressed(frameType, data)
 }
 
-// func buildFrame(data []byte, frameType FrameType) ([]byte, error) {
-// 	headerBuff := []byte{0, 0, 0, 0}
-
-// 	payload := []byte{}
-
-// 	payload = append(payload, data...)
-
-// 	binary.BigEndian.PutUint32(headerBuff, uint32(len(payload)+1))
-// 	headerBuff = append(headerBuff, byte(frameType))
-
-// 	frameBuff := []byte{}
-// 	frameBuff = append(frameBuff, headerBuff...)
-// 	frameBuff = append(frameBuff, payload...)
-
-// 	return frameBuff, nil
-// }
-
-func raw(socket *Socket, data []byte, frameType FrameType) {
-	if !socket.connected {
-		return
+// compressed is send for payloads that are worth compressing, failing
+// once sess has closed.
+func (sess *session) compressed(frameType protocol.FrameType, data []byte) error {
+	select {
+	case <-sess.done:
+		return protocol.ErrConnectionClosed
+	default:
 	}
 
-	bufferedBytes := 0
-	dataLen := len(data)
-
-	// log.Println("raw sending", dataLen, "bytes")
-
-	header := []byte{0, 0, 0, 0, 0, byte(frameType)}
-
-	seq := uint16(socket.sequence.Next())
-
-	binary.BigEndian.PutUint16(header[2:4], seq)
-
-	if dataLen > 0 {
-		for bufferedBytes < dataLen {
-			headerLen := len(header)
-
-			frameEnd := bufferedBytes + (FRAME_SIZE - headerLen)
-			if frameEnd > dataLen {
-				frameEnd = bufferedBytes + (dataLen - bufferedBytes)
-			}
-			dataSlice := data[bufferedBytes:frameEnd]
-			sliceLen := len(dataSlice)
-
-			frameLen := sliceLen + headerLen
-
-			binary.BigEndian.PutUint16(header, uint16(frameLen-6))
-
-			buff := []byte{}
-
-			buff = append(buff, header...)
-			buff = append(buff, dataSlice...)
-
-			bufferedBytes += sliceLen
-
-			if bufferedBytes == dataLen {
-				buff[4] = 2
-			} else if bufferedBytes != 0 {
-				header[4] = 1
-			}
-
-			socket.buffer.append(int(seq), buff)
-		}
-	} else {
-		header[4] = 2
-		socket.buffer.append(int(seq), header)
+	data, flags, err := sess.compression.Compress(data)
+	if err != nil {
+		return err
 	}
-}
-
-func rawBytes(socket *Socket, frame []byte) {
-	// log.Println("rawBytes", frame[:6], len(frame))
-	if _, err := socket.connection.Write(frame); err != nil {
-		log.Println("rawBytes err", frame[:6], err)
-		return
+	seq, frames := sess.encoder.EncodeWithFlags(frameType, flags, data)
+	msg := &protocol.Outgoing{Seq: seq, Frames: frames}
+	if frameType == protocol.FRAME_TYPE_RESPONSE {
+		// dropping or refusing a response would leave the requester waiting
+		// until it times out
+		return sess.queue.PushBlocking(msg)
 	}
-	// socket.bytesSent += uint64(len(frame))
+	return sess.queue.Push(msg)
 }
 
-func send(socket *Socket, event, data string) {
-	emit(socket, event, []byte(data))
+func send(socket *Socket, event, data string) error {
+	return emit(socket, codec.CODEC_RAW, event, []byte(data))
 }
 
-func New(address string) *Socket {
-	return &Socket{
-		address:    address,
-		connection: nil,
-		events:     map[string]MessageHandler{},
-		connected:  true,
-		sequence:   &Sequencer{UpperBoundBits: 16},
+// New creates a socket for the server at address, failing if address or
+// any of the options is invalid. Call Start or Listen to connect.
+func New(address string, options ...Option) (*Socket, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("Invalid address %q: %v", address, err)
+	}
+
+	socket := &Socket{
+		address:             address,
+		codecs:              codec.NewRegistry(),
+		eventSizeLimits:     map[string]int{},
+		highWaterMark:       protocol.DEFAULT_HIGH_WATER_MARK,
+		overflowPolicy:      protocol.OVERFLOW_BLOCK,
+		heartbeatInterval:   time.Second * HEARTBEAT_INTERVAL,
+		maxMissedHeartbeats: protocol.DEFAULT_MISSED_HEARTBEATS,
+		frameSize:           protocol.FRAME_SIZE,
+		requestTimeout:      protocol.DEFAULT_REQUEST_TIMEOUT,
+		maxMessageSize:      protocol.DEFAULT_MAX_MESSAGE_SIZE,
+		logger:              log.Default(),
+		closing:             make(chan struct{}),
+		errorEvent:          logError,
+		disconnectEvent:     func(reason *protocol.CloseReason) {},
+	}
+	for _, option := range options {
+		if err := option(socket); err != nil {
+			return nil, err
+		}
 	}
+	socket.dispatcher = protocol.NewDispatcher(socket.dispatchMode)
+	return socket, nil
 }
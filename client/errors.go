@@ -0,0 +1,62 @@
+package client
+
+import (
+	"errors"
+	"runtime/debug"
+	"time"
+
+	"go-sockets/protocol"
+)
+
+// CLOSE_FLUSH_TIMEOUT is how long the client waits for its close frame to
+// be written before hanging up.
+const CLOSE_FLUSH_TIMEOUT = time.Second
+
+type ErrorHandler func(socket *Socket, err error)
+
+// OnError sets the handler for panics in event, request and stream
+// handlers as a *protocol.PanicError, protocol violations by the server as
+// a *protocol.ProtocolError (the connection is closed right after), errors
+// returned by middleware for plain events, replies to requests that could
+// not be sent and, for sockets started with Start, why reconnecting gave
+// up. By default they are logged.
+func (s *Socket) OnError(handler ErrorHandler) {
+	s.errorEvent = handler
+}
+
+func (s *Socket) reportError(err error) {
+	s.errorEvent(s, err)
+}
+
+// fail reports a protocol violation and closes sess, telling the server
+// why.
+func (s *Socket) fail(sess *session, err error) *protocol.CloseReason {
+	s.reportError(err)
+	return s.close(sess, protocol.NewCloseReason(protocol.CLOSE_PROTOCOL_ERROR, err.Error()))
+}
+
+// oversize reports a message over the size limit and closes sess, telling
+// the server why.
+func (s *Socket) oversize(sess *session, err error) *protocol.CloseReason {
+	s.reportError(err)
+	return s.close(sess, protocol.NewCloseReason(protocol.CLOSE_OVERSIZE, err.Error()))
+}
+
+// guard runs fn, turning a panic into a *protocol.PanicError.
+func guard(event string, fn func() error) (err error) {
+	defer func() {
+		if value := recover(); value != nil {
+			err = &protocol.PanicError{Event: event, Value: value, Stack: debug.Stack()}
+		}
+	}()
+	return fn()
+}
+
+func logError(socket *Socket, err error) {
+	var panicErr *protocol.PanicError
+	if errors.As(err, &panicErr) {
+		socket.logger.Printf("%v\n%s", err, panicErr.Stack)
+		return
+	}
+	socket.logger.Println(err)
+}
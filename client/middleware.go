@@ -0,0 +1,46 @@
+package client
+
+import "go-sockets/protocol"
+
+// Handler handles an event or request from the server. An error fails a
+// request with that error as the reply; for plain events it is only
+// logged.
+type Handler func(socket *Socket, msg *protocol.Message) error
+
+// Middleware wraps the handling of events and requests from the server. It
+// may inspect or modify msg before calling next, time or log the call, or
+// short-circuit it by not calling next at all. Local events such as
+// "connection" do not pass through middleware.
+type Middleware func(next Handler) Handler
+
+// Use adds middleware, which run in the order they were added.
+func (s *Socket) Use(middleware ...Middleware) {
+	s.middlewareMutex.Lock()
+	defer s.middlewareMutex.Unlock()
+	s.middleware = append(s.middleware, middleware...)
+}
+
+// chain wraps final in the socket's middleware.
+func (s *Socket) chain(final Handler) Handler {
+	s.middlewareMutex.RLock()
+	middleware := s.middleware
+	s.middlewareMutex.RUnlock()
+
+	handler := final
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+func (s *Socket) handleMessage(msg *protocol.Message) {
+	err := guard(msg.Event, func() error {
+		return s.chain(func(socket *Socket, msg *protocol.Message) error {
+			socket.Envoke(msg)
+			return nil
+		})(s, msg)
+	})
+	if err != nil {
+		s.reportError(err)
+	}
+}
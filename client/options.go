@@ -0,0 +1,303 @@
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go-sockets/codec"
+	"go-sockets/compress"
+	"go-sockets/protocol"
+)
+
+// Option configures a Socket. Options check their arguments, so New fails
+// with a descriptive error instead of the socket misbehaving later.
+type Option func(*Socket) error
+
+// WithReconnect makes the socket redial the server with exponential backoff
+// whenever the connection drops, firing "reconnecting" before every attempt
+// and "reconnected" once it succeeds, followed by "connection" as usual.
+func WithReconnect(policy ReconnectPolicy) Option {
+	return func(s *Socket) error {
+		if err := policy.validate(); err != nil {
+			return err
+		}
+		s.reconnectPolicy = &policy
+		return nil
+	}
+}
+
+// WithTLS makes the client dial the server over TLS. Put a client
+// certificate in config.Certificates for servers that require mutual TLS.
+func WithTLS(config *tls.Config) Option {
+	return func(s *Socket) error {
+		if config == nil {
+			return errors.New("TLS config must not be nil")
+		}
+		s.tlsConfig = config
+		return nil
+	}
+}
+
+// WithSendQueue bounds the outbound queue to highWaterMark bytes and sets
+// what Send and Emit do when it is full.
+func WithSendQueue(highWaterMark int, policy protocol.OverflowPolicy) Option {
+	return func(s *Socket) error {
+		if highWaterMark <= 0 {
+			return fmt.Errorf("Send queue high-water mark must be positive, got %v", highWaterMark)
+		}
+		if policy != protocol.OVERFLOW_BLOCK && policy != protocol.OVERFLOW_DROP_OLDEST && policy != protocol.OVERFLOW_ERROR {
+			return fmt.Errorf("Unknown overflow policy %v", policy)
+		}
+		s.highWaterMark = highWaterMark
+		s.overflowPolicy = policy
+		return nil
+	}
+}
+
+// WithToken authenticates with a bearer token on servers that require it.
+func WithToken(token string) Option {
+	return func(s *Socket) error {
+		if token == "" {
+			return errors.New("Token must not be empty")
+		}
+		s.credentials = func(challenge []byte) *protocol.Credentials {
+			return &protocol.Credentials{Method: protocol.AUTH_TOKEN, Secret: []byte(token)}
+		}
+		return nil
+	}
+}
+
+// WithPassword authenticates with a username and password on servers that
+// require it. Only use it over TLS.
+func WithPassword(username, password string) Option {
+	return func(s *Socket) error {
+		if username == "" {
+			return errors.New("Username must not be empty")
+		}
+		s.credentials = func(challenge []byte) *protocol.Credentials {
+			return &protocol.Credentials{Method: protocol.AUTH_PASSWORD, Username: username, Secret: []byte(password)}
+		}
+		return nil
+	}
+}
+
+// WithHMAC authenticates by signing the server's challenge with key, so the
+// key itself never goes over the wire.
+func WithHMAC(username string, key []byte) Option {
+	return func(s *Socket) error {
+		if len(key) == 0 {
+			return errors.New("HMAC key must not be empty")
+		}
+		s.credentials = func(challenge []byte) *protocol.Credentials {
+			return &protocol.Credentials{Method: protocol.AUTH_HMAC, Username: username, Secret: protocol.SignChallenge(key, challenge)}
+		}
+		return nil
+	}
+}
+
+// WithDispatch sets in which order event and request handlers run. The
+// default, protocol.DISPATCH_CONCURRENT, runs them all at once; the ordered
+// modes run them one at a time in arrival order, for the whole socket or
+// per event. Stream handlers always run concurrently. In the ordered modes
+// a large message is handled before the ones sent after it even if their
+// chunks overtook it on the wire.
+func WithDispatch(mode protocol.DispatchMode) Option {
+	return func(s *Socket) error {
+		if mode != protocol.DISPATCH_CONCURRENT && mode != protocol.DISPATCH_ORDERED && mode != protocol.DISPATCH_ORDERED_PER_EVENT {
+			return fmt.Errorf("Unknown dispatch mode %v", mode)
+		}
+		s.dispatchMode = mode
+		return nil
+	}
+}
+
+// WithHeartbeat sets how often the server is sent a heartbeat. The interval
+// is offered during the handshake and both sides use the shorter of theirs
+// and the server's. The default is HEARTBEAT_INTERVAL seconds and the
+// minimum protocol.MIN_HEARTBEAT_INTERVAL.
+func WithHeartbeat(interval time.Duration) Option {
+	return func(s *Socket) error {
+		if interval < protocol.MIN_HEARTBEAT_INTERVAL {
+			return fmt.Errorf("Heartbeat interval must be at least %v, got %v", protocol.MIN_HEARTBEAT_INTERVAL, interval)
+		}
+		s.heartbeatInterval = interval
+		return nil
+	}
+}
+
+// WithHeartbeatTolerance sets how many heartbeat intervals the server may
+// stay silent before the connection is dropped with
+// protocol.CLOSE_TIMEOUT. The default is
+// protocol.DEFAULT_MISSED_HEARTBEATS.
+func WithHeartbeatTolerance(missed int) Option {
+	return func(s *Socket) error {
+		if missed < 1 {
+			return fmt.Errorf("Heartbeat tolerance must be at least 1, got %v", missed)
+		}
+		s.maxMissedHeartbeats = missed
+		return nil
+	}
+}
+
+// WithFrameSize sets the largest frame, header included, the client offers
+// to send and receive; messages are split into chunks of that size. The
+// smaller of the two sides' frame sizes is used. The default is
+// protocol.FRAME_SIZE and the minimum protocol.MIN_FRAME_SIZE.
+func WithFrameSize(size int) Option {
+	return func(s *Socket) error {
+		if size < protocol.MIN_FRAME_SIZE {
+			return fmt.Errorf("Frame size must be at least %v bytes, got %v", protocol.MIN_FRAME_SIZE, size)
+		}
+		s.frameSize = size
+		return nil
+	}
+}
+
+// WithMaxMessageSize sets the largest message, after reassembling its
+// chunks, the client accepts. The connection is dropped if the server
+// sends a bigger one or keeps more than protocol.MAX_BUFFERED_MESSAGES
+// times as much half-sent at once. The default is
+// protocol.DEFAULT_MAX_MESSAGE_SIZE; 0 accepts messages of any size.
+func WithMaxMessageSize(size int) Option {
+	return func(s *Socket) error {
+		if size < 0 {
+			return fmt.Errorf("Maximum message size must not be negative, got %v", size)
+		}
+		s.maxMessageSize = size
+		return nil
+	}
+}
+
+// WithEventSizeLimit lowers the maximum message size for messages and
+// requests on event, which may be a pattern such as "uploads.*". The limit
+// is checked while the message is reassembled; a server sending a bigger
+// one is disconnected. If several limits match an event, the smallest
+// applies. Streams are not limited.
+func WithEventSizeLimit(event string, size int) Option {
+	return func(s *Socket) error {
+		if event == "" {
+			return errors.New("Event must not be empty")
+		}
+		if size <= 0 {
+			return fmt.Errorf("Size limit for event %v must be positive, got %v", event, size)
+		}
+		s.eventSizeLimits[event] = size
+		return nil
+	}
+}
+
+// WithIdleTimeout drops the connection with protocol.CLOSE_IDLE_TIMEOUT
+// once no messages, requests, responses or stream data have gone either way
+// for longer than timeout. Heartbeats do not count as traffic. The default
+// of 0 never does.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(s *Socket) error {
+		if timeout < 0 {
+			return fmt.Errorf("Idle timeout must not be negative, got %v", timeout)
+		}
+		s.idleTimeout = timeout
+		return nil
+	}
+}
+
+// WithReadTimeout drops the connection with protocol.CLOSE_READ_TIMEOUT if
+// the rest of a frame takes longer than timeout to arrive once its first
+// byte has. The default of 0 waits forever.
+func WithReadTimeout(timeout time.Duration) Option {
+	return func(s *Socket) error {
+		if timeout < 0 {
+			return fmt.Errorf("Read timeout must not be negative, got %v", timeout)
+		}
+		s.readTimeout = timeout
+		return nil
+	}
+}
+
+// WithWriteTimeout drops the connection with protocol.CLOSE_WRITE_TIMEOUT
+// if writing a frame to the server takes longer than timeout, which happens
+// once the server stops reading and the connection's buffers fill up. The
+// default of 0 waits forever.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(s *Socket) error {
+		if timeout < 0 {
+			return fmt.Errorf("Write timeout must not be negative, got %v", timeout)
+		}
+		s.writeTimeout = timeout
+		return nil
+	}
+}
+
+// WithDialTimeout limits how long connecting to the server may take. The
+// default of 0 leaves it to the operating system.
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(s *Socket) error {
+		if timeout < 0 {
+			return fmt.Errorf("Dial timeout must not be negative, got %v", timeout)
+		}
+		s.dialTimeout = timeout
+		return nil
+	}
+}
+
+// WithRequestTimeout sets how long Request waits for a reply when its
+// context has no deadline. The default is
+// protocol.DEFAULT_REQUEST_TIMEOUT.
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(s *Socket) error {
+		if timeout <= 0 {
+			return fmt.Errorf("Request timeout must be positive, got %v", timeout)
+		}
+		s.requestTimeout = timeout
+		return nil
+	}
+}
+
+// WithCompression offers the server compressors, which default to
+// compress.Defaults(), in order of preference. If the server agrees to
+// one, message, request and response payloads of at least minSize bytes
+// are compressed. Payloads that do not shrink are sent as they are.
+func WithCompression(minSize int, compressors ...compress.Compressor) Option {
+	return func(s *Socket) error {
+		if minSize < 0 {
+			return fmt.Errorf("Minimum compression size must not be negative, got %v", minSize)
+		}
+		if len(compressors) == 0 {
+			compressors = compress.Defaults()
+		}
+		seen := map[byte]bool{}
+		for _, c := range compressors {
+			if c == nil {
+				return errors.New("Compressor must not be nil")
+			}
+			if c.Id() == 0 || seen[c.Id()] {
+				return fmt.Errorf("Compressor %v has a reserved or duplicate id %v", c.Name(), c.Id())
+			}
+			seen[c.Id()] = true
+		}
+		s.compressors = compressors
+		s.minCompressSize = minSize
+		return nil
+	}
+}
+
+// WithCodec registers c like RegisterCodec.
+func WithCodec(c codec.Codec, makeDefault bool) Option {
+	return func(s *Socket) error {
+		return s.RegisterCodec(c, makeDefault)
+	}
+}
+
+// WithLogger sends the socket's log output to logger instead of the
+// standard logger.
+func WithLogger(logger *log.Logger) Option {
+	return func(s *Socket) error {
+		if logger == nil {
+			return errors.New("Logger must not be nil")
+		}
+		s.logger = logger
+		return nil
+	}
+}
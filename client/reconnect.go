@@ -0,0 +1,58 @@
+package client
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ReconnectPolicy controls how a client with reconnection enabled retries
+// after losing its connection. The n-th attempt waits
+// InitialDelay*Multiplier^(n-1), capped at MaxDelay and randomised by up to
+// Jitter (a fraction of the delay) in either direction.
+type ReconnectPolicy struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+	Jitter       float64
+	// MaxAttempts of 0 retries forever.
+	MaxAttempts int
+}
+
+var DefaultReconnectPolicy = ReconnectPolicy{
+	InitialDelay: time.Millisecond * 500,
+	MaxDelay:     time.Second * 30,
+	Multiplier:   2,
+	Jitter:       0.2,
+}
+
+func (p *ReconnectPolicy) delay(attempt int) time.Duration {
+	delay := float64(p.InitialDelay) * math.Pow(p.Multiplier, float64(attempt-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(delay)
+}
+
+func (p *ReconnectPolicy) validate() error {
+	if p.InitialDelay <= 0 {
+		return fmt.Errorf("Reconnect initial delay must be positive, got %v", p.InitialDelay)
+	}
+	if p.MaxDelay != 0 && p.MaxDelay < p.InitialDelay {
+		return fmt.Errorf("Reconnect max delay %v is shorter than the initial delay %v", p.MaxDelay, p.InitialDelay)
+	}
+	if p.Multiplier < 1 {
+		return fmt.Errorf("Reconnect multiplier must be at least 1, got %v", p.Multiplier)
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("Reconnect jitter must be between 0 and 1, got %v", p.Jitter)
+	}
+	if p.MaxAttempts < 0 {
+		return fmt.Errorf("Reconnect max attempts must not be negative, got %v", p.MaxAttempts)
+	}
+	return nil
+}
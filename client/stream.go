@@ -0,0 +1,65 @@
+package client
+
+import (
+	"io"
+
+	"go-sockets/protocol"
+)
+
+type StreamHandler = protocol.StreamHandler
+
+// OpenStream starts a stream on event. Everything written is sent in
+// chunks without buffering the whole payload; writes block while the send
+// queue is full regardless of the overflow policy, and while the server's
+// handler has protocol.STREAM_WINDOW bytes left to read. Close finishes the
+// stream; the writer is a *protocol.StreamWriter whose CloseWithError
+// aborts it instead. Writes fail with protocol.ErrStreamCanceled once the
+// server stops reading the stream. A stream does not survive a reconnect.
+func (s *Socket) OpenStream(event string) (io.WriteCloser, error) {
+	sess := s.current()
+	if sess == nil || !s.connected.Load() {
+		return nil, protocol.ErrConnectionClosed
+	}
+
+	return sess.transfers.Open(event, sess.encoder.MaxPayload(), func(payload []byte) error {
+		select {
+		case <-sess.done:
+			return protocol.ErrConnectionClosed
+		default:
+		}
+		seq, frames := sess.encoder.Encode(protocol.FRAME_TYPE_STREAM, payload)
+		return sess.queue.PushBlocking(&protocol.Outgoing{Seq: seq, Frames: frames})
+	})
+}
+
+func processStreamFrame(s *Socket, sess *session, payload []byte) error {
+	frame, err := protocol.DecodeStreamFrame(payload)
+	if err != nil {
+		return err
+	}
+
+	if frame.Kind != protocol.STREAM_OPEN {
+		// waiting for a handler to catch up is not the server going silent
+		defer sess.keepalive.Hold()()
+		return sess.transfers.Feed(frame)
+	}
+
+	handler, ok := s.StreamHandlerFor(string(frame.Data))
+	if !ok {
+		sess.transfers.Refuse(frame.Id)
+		return nil
+	}
+
+	event := string(frame.Data)
+	reader := sess.transfers.Accept(frame.Id)
+	go func() {
+		defer reader.Close()
+		if err := guard(event, func() error {
+			handler(reader)
+			return nil
+		}); err != nil {
+			s.reportError(err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,29 @@
+package client
+
+import (
+	"go-sockets/protocol"
+)
+
+// OnTyped registers a handler for event whose payload is decoded into a T
+// with the codec the sender encoded it with.
+func OnTyped[T any](socket *Socket, event string, handler func(T)) *Subscription {
+	return socket.OnMessage(event, func(msg *protocol.Message) {
+		var v T
+		if err := socket.codecs.Unmarshal(msg.Codec, msg.Data, &v); err != nil {
+			socket.logger.Printf("Couldn't decode payload of event %v: %v\n", event, err)
+			return
+		}
+		handler(v)
+	})
+}
+
+// EmitTyped encodes v with the default codec and emits it on event.
+func EmitTyped(socket *Socket, event string, v any) error {
+	c := socket.codecs.Default()
+	data, err := c.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return emit(socket, c.Id(), event, data)
+}
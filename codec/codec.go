@@ -0,0 +1,99 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	CODEC_RAW  byte = 0
+	CODEC_JSON byte = 1
+	CODEC_GOB  byte = 2
+	// ids 3 (MessagePack) and 4 (protobuf) are reserved for codecs
+	// registered by applications
+	CODEC_MSGPACK  byte = 3
+	CODEC_PROTOBUF byte = 4
+)
+
+var ErrRawCodec = errors.New("Codec id 0 is reserved for raw payloads")
+
+// Codec serialises typed event payloads. Its Id travels with every message
+// so the receiving side can pick the same codec to decode it.
+type Codec interface {
+	Id() byte
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type Registry struct {
+	codecs   map[byte]Codec
+	fallback byte
+	mutex    sync.RWMutex
+}
+
+func (r *Registry) Register(c Codec) error {
+	if c.Id() == CODEC_RAW {
+		return ErrRawCodec
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.codecs[c.Id()] = c
+	return nil
+}
+
+func (r *Registry) Get(id byte) (Codec, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if c, ok := r.codecs[id]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("No codec registered with id %v", id)
+}
+
+// Default returns the codec used to encode typed events.
+func (r *Registry) Default() Codec {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.codecs[r.fallback]
+}
+
+func (r *Registry) SetDefault(id byte) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.codecs[id]; !ok {
+		return fmt.Errorf("No codec registered with id %v", id)
+	}
+	r.fallback = id
+	return nil
+}
+
+// NewRegistry returns a registry holding the JSON and gob codecs, with JSON
+// as the default.
+func NewRegistry() *Registry {
+	return &Registry{
+		codecs: map[byte]Codec{
+			CODEC_JSON: JSON{},
+			CODEC_GOB:  Gob{},
+		},
+		fallback: CODEC_JSON,
+	}
+}
+
+// Unmarshal decodes data with the codec registered under id. Raw payloads
+// are decoded with the default codec.
+func (r *Registry) Unmarshal(id byte, data []byte, v interface{}) error {
+	if id == CODEC_RAW {
+		return r.Default().Unmarshal(data, v)
+	}
+
+	c, err := r.Get(id)
+	if err != nil {
+		return err
+	}
+	return c.Unmarshal(data, v)
+}
@@ -0,0 +1,28 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+type Gob struct{}
+
+func (Gob) Id() byte {
+	return CODEC_GOB
+}
+
+func (Gob) Name() string {
+	return "gob"
+}
+
+func (Gob) Marshal(v interface{}) ([]byte, error) {
+	var buff bytes.Buffer
+	if err := gob.NewEncoder(&buff).Encode(v); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+func (Gob) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
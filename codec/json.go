@@ -0,0 +1,21 @@
+package codec
+
+import "encoding/json"
+
+type JSON struct{}
+
+func (JSON) Id() byte {
+	return CODEC_JSON
+}
+
+func (JSON) Name() string {
+	return "json"
+}
+
+func (JSON) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSON) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
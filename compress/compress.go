@@ -0,0 +1,23 @@
+package compress
+
+import "io"
+
+const (
+	// id 0 means the payload is not compressed
+	COMPRESS_GZIP    byte = 1
+	COMPRESS_DEFLATE byte = 2
+)
+
+// Compressor compresses message payloads. Its Id is agreed on during the
+// handshake, so both sides must know a compressor under the same id.
+type Compressor interface {
+	Id() byte
+	Name() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// Defaults returns the compressors from the standard library, gzip first.
+func Defaults() []Compressor {
+	return []Compressor{Gzip{}, Deflate{}}
+}
@@ -0,0 +1,31 @@
+package compress
+
+import (
+	"compress/flate"
+	"io"
+)
+
+// Deflate compresses with compress/flate. A zero Level is
+// flate.DefaultCompression.
+type Deflate struct {
+	Level int
+}
+
+func (Deflate) Id() byte {
+	return COMPRESS_DEFLATE
+}
+
+func (Deflate) Name() string {
+	return "deflate"
+}
+
+func (d Deflate) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	if d.Level == 0 {
+		return flate.NewWriter(w, flate.DefaultCompression)
+	}
+	return flate.NewWriter(w, d.Level)
+}
+
+func (Deflate) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
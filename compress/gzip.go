@@ -0,0 +1,31 @@
+package compress
+
+import (
+	"compress/gzip"
+	"io"
+)
+
+// Gzip compresses with compress/gzip. A zero Level is
+// gzip.DefaultCompression.
+type Gzip struct {
+	Level int
+}
+
+func (Gzip) Id() byte {
+	return COMPRESS_GZIP
+}
+
+func (Gzip) Name() string {
+	return "gzip"
+}
+
+func (g Gzip) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	if g.Level == 0 {
+		return gzip.NewWriter(w), nil
+	}
+	return gzip.NewWriterLevel(w, g.Level)
+}
+
+func (Gzip) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"go-sockets/client"
+	"go-sockets/protocol"
 )
 
 func mbToInt(size string) int {
@@ -31,7 +32,10 @@ func mbSlice(size string) []byte {
 }
 
 func main() {
-	socket := client.New("localhost:9090")
+	socket, err := client.New("localhost:9090")
+	if err != nil {
+		log.Fatalf("Couldn't create socket: %v", err)
+	}
 
 	// go func() {
 	// 	for {
@@ -77,11 +81,11 @@ func main() {
 		}()
 	})
 
-	socket.On("disconnection", func(_ string) {
-		log.Println("disconnection: disconnected from server")
+	socket.OnDisconnection(func(reason *protocol.CloseReason) {
+		log.Printf("disconnection: disconnected from server (%v)\n", reason)
 	})
 
-	err := socket.Listen()
+	err = socket.Listen()
 
 	if err != nil {
 		log.Fatalf("Couldn't connect to server: %v", err)
@@ -5,6 +5,7 @@ import (
 	"log"
 	"strconv"
 
+	"go-sockets/protocol"
 	"go-sockets/server"
 )
 
@@ -30,7 +31,10 @@ func mbSlice(size string) []byte {
 }
 
 func main() {
-	srv := server.New(":9090")
+	srv, err := server.New(":9090")
+	if err != nil {
+		log.Fatalf("Couldn't create server: %v", err)
+	}
 
 	// go func() {
 	// 	for {
@@ -76,11 +80,11 @@ func main() {
 		})
 	})
 
-	srv.OnDisconnection(func(socket *server.Socket) {
-		log.Printf("socket disconnected with id: %v\n", socket.Id)
+	srv.OnDisconnection(func(socket *server.Socket, reason *protocol.CloseReason) {
+		log.Printf("socket disconnected with id: %v (%v)\n", socket.Id, reason)
 	})
 
-	err := srv.Listen()
+	err = srv.Listen()
 
 	if err != nil {
 		log.Fatalf("Failed to start server: %v", err)
@@ -0,0 +1,96 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	FRAME_TYPE_AUTH FrameType = 98
+)
+
+type AuthMethod byte
+
+const (
+	AUTH_NONE     AuthMethod = 0
+	AUTH_TOKEN    AuthMethod = 1
+	AUTH_PASSWORD AuthMethod = 2
+	AUTH_HMAC     AuthMethod = 3
+)
+
+const CHALLENGE_SIZE int = 32
+
+var ErrMalformedCredentials = errors.New("Malformed credentials")
+
+// AuthError is returned when the server rejects a client's credentials.
+type AuthError struct {
+	Reason string
+}
+
+func (e *AuthError) Error() string {
+	return "Authentication failed: " + e.Reason
+}
+
+// Credentials is the payload of the client's FRAME_TYPE_AUTH frame. When
+// FEATURE_AUTH is accepted, the server follows its READY frame with an
+// AUTH frame holding a random challenge, the client answers with its
+// credentials and the server either sends an empty AUTH frame to let it in
+// or a CLOSE frame with the reason it was rejected.
+//
+//	| method byte | username length uint16 | username | secret ... |
+//
+// The secret is a token, a password or, for AUTH_HMAC, the challenge
+// signed with SignChallenge.
+type Credentials struct {
+	Method   AuthMethod
+	Username string
+	Secret   []byte
+}
+
+func (c *Credentials) Bytes() []byte {
+	buff := make([]byte, 3, 3+len(c.Username)+len(c.Secret))
+	buff[0] = byte(c.Method)
+	binary.BigEndian.PutUint16(buff[1:3], uint16(len(c.Username)))
+	buff = append(buff, c.Username...)
+	return append(buff, c.Secret...)
+}
+
+func DecodeCredentials(payload []byte) (*Credentials, error) {
+	if len(payload) < 3 {
+		return nil, ErrMalformedCredentials
+	}
+
+	size := int(binary.BigEndian.Uint16(payload[1:3]))
+	if len(payload) < 3+size {
+		return nil, ErrMalformedCredentials
+	}
+
+	return &Credentials{
+		Method:   AuthMethod(payload[0]),
+		Username: string(payload[3 : 3+size]),
+		Secret:   payload[3+size:],
+	}, nil
+}
+
+func NewChallenge() ([]byte, error) {
+	challenge := make([]byte, CHALLENGE_SIZE)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// SignChallenge is the HMAC-SHA256 of challenge under key.
+func SignChallenge(key, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+// VerifyChallenge reports whether signature is challenge signed with key.
+func VerifyChallenge(key, challenge, signature []byte) bool {
+	return hmac.Equal(SignChallenge(key, challenge), signature)
+}
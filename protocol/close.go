@@ -0,0 +1,105 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+type CloseCode uint16
+
+const (
+	// CLOSE_NORMAL is a peer hanging up deliberately.
+	CLOSE_NORMAL CloseCode = 1000
+	// CLOSE_SHUTDOWN is the server shutting down.
+	CLOSE_SHUTDOWN CloseCode = 1001
+	// CLOSE_KICKED is the server dropping a single socket.
+	CLOSE_KICKED CloseCode = 1002
+	// CLOSE_AUTH_FAILED is the server rejecting a client's credentials.
+	CLOSE_AUTH_FAILED CloseCode = 1003
+	// CLOSE_PROTOCOL_ERROR is a peer violating the protocol.
+	CLOSE_PROTOCOL_ERROR CloseCode = 1004
+	// CLOSE_TIMEOUT is a peer that stopped answering heartbeats.
+	CLOSE_TIMEOUT CloseCode = 1005
+	// CLOSE_OVERSIZE is a peer sending a message over the size limit.
+	CLOSE_OVERSIZE CloseCode = 1006
+	// CLOSE_CONNECTION_LOST is a connection that dropped without a close
+	// frame. It is never sent.
+	CLOSE_CONNECTION_LOST CloseCode = 1007
+	// CLOSE_IDLE_TIMEOUT is a connection without application traffic for
+	// longer than the idle timeout.
+	CLOSE_IDLE_TIMEOUT CloseCode = 1008
+	// CLOSE_READ_TIMEOUT is a peer that stalled in the middle of a frame.
+	CLOSE_READ_TIMEOUT CloseCode = 1009
+	// CLOSE_WRITE_TIMEOUT is a peer that stopped reading, so a write did
+	// not complete in time. It is never sent.
+	CLOSE_WRITE_TIMEOUT CloseCode = 1010
+)
+
+var closeCodeNames = map[CloseCode]string{
+	CLOSE_NORMAL:          "normal",
+	CLOSE_SHUTDOWN:        "server shutdown",
+	CLOSE_KICKED:          "kicked",
+	CLOSE_AUTH_FAILED:     "auth failed",
+	CLOSE_PROTOCOL_ERROR:  "protocol error",
+	CLOSE_TIMEOUT:         "timeout",
+	CLOSE_OVERSIZE:        "oversize",
+	CLOSE_CONNECTION_LOST: "connection lost",
+	CLOSE_IDLE_TIMEOUT:    "idle timeout",
+	CLOSE_READ_TIMEOUT:    "read timeout",
+	CLOSE_WRITE_TIMEOUT:   "write timeout",
+}
+
+var ErrMalformedClose = errors.New("Malformed close frame")
+
+func (c CloseCode) String() string {
+	if name, ok := closeCodeNames[c]; ok {
+		return name
+	}
+	return "close code " + strconv.Itoa(int(c))
+}
+
+// CloseReason is why a connection ended. It is the payload of a
+// FRAME_TYPE_CLOSE frame:
+//
+//	| code uint16 | reason ... |
+//
+// An empty payload is CLOSE_NORMAL without a reason.
+type CloseReason struct {
+	Code   CloseCode
+	Reason string
+	// Remote is set if the peer sent the close frame.
+	Remote bool
+}
+
+func NewCloseReason(code CloseCode, reason string) *CloseReason {
+	return &CloseReason{Code: code, Reason: reason}
+}
+
+func (r *CloseReason) Bytes() []byte {
+	buff := make([]byte, 2, 2+len(r.Reason))
+	binary.BigEndian.PutUint16(buff, uint16(r.Code))
+	return append(buff, r.Reason...)
+}
+
+func (r *CloseReason) Error() string {
+	if r.Reason == "" {
+		return r.Code.String()
+	}
+	return r.Code.String() + ": " + r.Reason
+}
+
+func DecodeCloseReason(payload []byte) (*CloseReason, error) {
+	if len(payload) == 0 {
+		return &CloseReason{Code: CLOSE_NORMAL, Remote: true}, nil
+	}
+	if len(payload) < 2 {
+		return nil, ErrMalformedClose
+	}
+
+	return &CloseReason{
+		Code:   CloseCode(binary.BigEndian.Uint16(payload[0:2])),
+		Reason: string(payload[2:]),
+		Remote: true,
+	}, nil
+}
@@ -0,0 +1,100 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"go-sockets/compress"
+)
+
+// DEFAULT_MIN_COMPRESS_SIZE is the smallest payload worth compressing.
+const DEFAULT_MIN_COMPRESS_SIZE int = 1024
+
+var ErrNotCompressing = errors.New("Received a compressed frame without negotiating compression")
+
+// Compression compresses the message payloads of one connection with the
+// compressor agreed on during the handshake. A nil *Compression leaves
+// payloads alone.
+type Compression struct {
+	Compressor compress.Compressor
+	// MinSize is the smallest payload that gets compressed.
+	MinSize int
+	// MaxSize, if positive, is the largest payload Decompress inflates to;
+	// a bigger one fails with ErrMessageTooLarge.
+	MaxSize int
+}
+
+// Compress returns data compressed along with FLAG_COMPRESSED, or data
+// itself and no flags if it is too small or does not shrink.
+func (c *Compression) Compress(data []byte) ([]byte, byte, error) {
+	if c == nil || len(data) < c.MinSize {
+		return data, 0, nil
+	}
+
+	var buff bytes.Buffer
+	w, err := c.Compressor.NewWriter(&buff)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, 0, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, 0, err
+	}
+
+	if buff.Len() >= len(data) {
+		return data, 0, nil
+	}
+	return buff.Bytes(), FLAG_COMPRESSED, nil
+}
+
+func (c *Compression) Decompress(data []byte) ([]byte, error) {
+	if c == nil {
+		return nil, ErrNotCompressing
+	}
+
+	r, err := c.Compressor.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var src io.Reader = r
+	if c.MaxSize > 0 {
+		src = io.LimitReader(r, int64(c.MaxSize)+1)
+	}
+	payload, err := io.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	if c.MaxSize > 0 && len(payload) > c.MaxSize {
+		return nil, ErrMessageTooLarge
+	}
+	return payload, nil
+}
+
+// NewCompression returns the compression for the compressor the handshake
+// settled on, or nil if it did not settle on one.
+func NewCompression(accepted *Handshake, compressors []compress.Compressor, minSize, maxSize int) *Compression {
+	if !accepted.Has(FEATURE_COMPRESSION) || len(accepted.Compressors) == 0 {
+		return nil
+	}
+
+	for _, c := range compressors {
+		if c.Id() == accepted.Compressors[0] {
+			return &Compression{Compressor: c, MinSize: minSize, MaxSize: maxSize}
+		}
+	}
+	return nil
+}
+
+// CompressorIds lists the ids of compressors in order, for a handshake.
+func CompressorIds(compressors []compress.Compressor) []byte {
+	ids := make([]byte, len(compressors))
+	for i, c := range compressors {
+		ids[i] = c.Id()
+	}
+	return ids
+}
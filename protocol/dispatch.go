@@ -0,0 +1,71 @@
+package protocol
+
+import "sync"
+
+// DispatchMode decides in which order handlers for incoming messages run.
+type DispatchMode int
+
+const (
+	// DISPATCH_CONCURRENT runs every handler in its own goroutine as soon
+	// as its message arrives.
+	DISPATCH_CONCURRENT DispatchMode = iota
+	// DISPATCH_ORDERED runs the handlers of a connection one at a time, in
+	// the order their messages arrived.
+	DISPATCH_ORDERED
+	// DISPATCH_ORDERED_PER_EVENT runs the handlers of each event one at a
+	// time in arrival order, while different events run concurrently.
+	DISPATCH_ORDERED_PER_EVENT
+)
+
+// Dispatcher runs handlers according to a DispatchMode. In the ordered
+// modes a goroutine per queue drains it and exits once it is empty, so
+// idle connections hold no goroutines.
+type Dispatcher struct {
+	mode   DispatchMode
+	queues map[string][]func()
+	mutex  sync.Mutex
+}
+
+// Dispatch runs handler for a message on event.
+func (d *Dispatcher) Dispatch(event string, handler func()) {
+	if d.mode == DISPATCH_CONCURRENT {
+		go handler()
+		return
+	}
+
+	key := ""
+	if d.mode == DISPATCH_ORDERED_PER_EVENT {
+		key = event
+	}
+
+	d.mutex.Lock()
+	queue, draining := d.queues[key]
+	d.queues[key] = append(queue, handler)
+	d.mutex.Unlock()
+
+	if !draining {
+		go d.drain(key)
+	}
+}
+
+func (d *Dispatcher) drain(key string) {
+	for {
+		d.mutex.Lock()
+		queue := d.queues[key]
+		if len(queue) == 0 {
+			delete(d.queues, key)
+			d.mutex.Unlock()
+			return
+		}
+		handler := queue[0]
+		queue[0] = nil
+		d.queues[key] = queue[1:]
+		d.mutex.Unlock()
+
+		handler()
+	}
+}
+
+func NewDispatcher(mode DispatchMode) *Dispatcher {
+	return &Dispatcher{mode: mode, queues: map[string][]func(){}}
+}
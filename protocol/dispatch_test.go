@@ -0,0 +1,119 @@
+package protocol
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDispatcherOrdered(t *testing.T) {
+	d := NewDispatcher(DISPATCH_ORDERED)
+
+	var wg sync.WaitGroup
+	var got []int
+	for i := 0; i < 1000; i++ {
+		i := i
+		wg.Add(1)
+		// alternating events share one queue in this mode
+		event := []string{"a", "b"}[i%2]
+		d.Dispatch(event, func() {
+			defer wg.Done()
+			got = append(got, i)
+		})
+	}
+	wg.Wait()
+
+	for i, n := range got {
+		if n != i {
+			t.Fatalf("Handler %v ran as number %v", n, i)
+		}
+	}
+}
+
+func TestDispatcherOrderedPerEvent(t *testing.T) {
+	d := NewDispatcher(DISPATCH_ORDERED_PER_EVENT)
+
+	// a's first handler only returns once b's handler has run, which it
+	// could not if different events shared a queue
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	got := map[string][]int{}
+	record := func(event string, i int) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		got[event] = append(got[event], i)
+	}
+
+	wg.Add(3)
+	d.Dispatch("a", func() {
+		defer wg.Done()
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+			t.Error("Handler for b did not run while a was busy")
+		}
+		record("a", 0)
+	})
+	d.Dispatch("a", func() {
+		defer wg.Done()
+		record("a", 1)
+	})
+	d.Dispatch("b", func() {
+		defer wg.Done()
+		record("b", 0)
+		close(release)
+	})
+	wg.Wait()
+
+	if a := got["a"]; len(a) != 2 || a[0] != 0 || a[1] != 1 {
+		t.Fatalf("Handlers for a ran as %v, want [0 1]", a)
+	}
+}
+
+func TestDispatcherConcurrent(t *testing.T) {
+	d := NewDispatcher(DISPATCH_CONCURRENT)
+
+	second := make(chan struct{})
+	done := make(chan bool)
+	d.Dispatch("a", func() {
+		select {
+		case <-second:
+			done <- true
+		case <-time.After(5 * time.Second):
+			done <- false
+		}
+	})
+	d.Dispatch("a", func() {
+		close(second)
+	})
+
+	if !<-done {
+		t.Fatal("Second handler did not run while the first was busy")
+	}
+}
+
+func TestDispatcherReleasesIdleQueues(t *testing.T) {
+	d := NewDispatcher(DISPATCH_ORDERED_PER_EVENT)
+
+	var wg sync.WaitGroup
+	for _, event := range []string{"a", "b", "c"} {
+		wg.Add(1)
+		d.Dispatch(event, wg.Done)
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d.mutex.Lock()
+		left := len(d.queues)
+		d.mutex.Unlock()
+		if left == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v queues left after every handler ran", left)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,30 @@
+package protocol
+
+import "fmt"
+
+// ProtocolError is a peer violating the protocol, such as sending an
+// unknown frame type or a malformed payload. The offending connection is
+// closed.
+type ProtocolError struct {
+	Err error
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.Err.Error()
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// PanicError is a handler that panicked. Stack is the goroutine's stack at
+// the time of the panic.
+type PanicError struct {
+	Event string
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("Handler for event %v panicked: %v", e.Event, e.Value)
+}
@@ -0,0 +1,420 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type FrameType byte
+
+const (
+	FRAME_SIZE               int       = 4096
+	FRAME_HEADER_SIZE        int       = 8
+	FRAME_TYPE_MESSAGE       FrameType = 90
+	FRAME_TYPE_HEARTBEAT     FrameType = 91
+	FRAME_TYPE_HEARTBEAT_ACK FrameType = 92
+	FRAME_TYPE_READY         FrameType = 93
+	FRAME_TYPE_CLOSE         FrameType = 96
+)
+
+// MIN_FRAME_SIZE is the smallest frame size a peer may offer. It leaves
+// room for the server's answer to a handshake in a single frame, so that
+// nothing can come between its chunks.
+const MIN_FRAME_SIZE = 64
+
+const (
+	// FLAG_FIN marks the last chunk of a frame sequence.
+	FLAG_FIN byte = 1 << 0
+	// FLAG_COMPRESSED marks the chunks of a compressed payload.
+	FLAG_COMPRESSED byte = 1 << 1
+)
+
+var (
+	ErrFrameTooShort   = errors.New("Frame is shorter than its header")
+	ErrFrameTooLarge   = errors.New("Frame exceeds the negotiated frame size")
+	ErrMessageTooLarge = errors.New("Message exceeds the maximum message size")
+	ErrBufferFull      = errors.New("Messages being reassembled exceed the buffer limit")
+)
+
+// Frame is a single chunk on the wire. Its header is laid out as:
+//
+//	| length uint32 | seq uint16 | flags byte | type byte | payload ... |
+//
+// where length is the size of the payload that follows the header.
+type Frame struct {
+	Type    FrameType
+	Seq     uint16
+	Flags   byte
+	Payload []byte
+}
+
+func (f *Frame) Last() bool {
+	return f.Flags&FLAG_FIN != 0
+}
+
+func (f *Frame) Compressed() bool {
+	return f.Flags&FLAG_COMPRESSED != 0
+}
+
+func (f *Frame) Bytes() []byte {
+	buff := make([]byte, FRAME_HEADER_SIZE+len(f.Payload))
+	binary.BigEndian.PutUint32(buff[0:4], uint32(len(f.Payload)))
+	binary.BigEndian.PutUint16(buff[4:6], f.Seq)
+	buff[6] = f.Flags
+	buff[7] = byte(f.Type)
+	copy(buff[FRAME_HEADER_SIZE:], f.Payload)
+	return buff
+}
+
+type Sequencer struct {
+	current        int64
+	UpperBoundBits uint
+	mutex          sync.Mutex
+}
+
+func (seq *Sequencer) Next() int64 {
+	seq.mutex.Lock()
+	defer seq.mutex.Unlock()
+	if seq.current == 1<<seq.UpperBoundBits-1 {
+		seq.current = 0
+	}
+
+	next := seq.current
+	seq.current++
+	return next
+}
+
+func (seq *Sequencer) Val() int64 {
+	if seq.current == 0 {
+		return seq.current
+	}
+	return seq.current - 1
+}
+
+// Encoder turns payloads into wire frames. Payloads larger than FrameSize
+// (header included) are split into chunks sharing one sequence number; a
+// FrameSize that cannot fit a header sends every payload as a single frame.
+type Encoder struct {
+	FrameSize int
+	// Activity, if set, is touched for every frame carrying application
+	// data.
+	Activity *Activity
+	sequence *Sequencer
+}
+
+// MaxPayload is the largest payload that fits in a single frame, or 0 if
+// payloads are never split.
+func (e *Encoder) MaxPayload() int {
+	if e.FrameSize <= FRAME_HEADER_SIZE {
+		return 0
+	}
+	return e.FrameSize - FRAME_HEADER_SIZE
+}
+
+func (e *Encoder) Encode(frameType FrameType, data []byte) (uint16, [][]byte) {
+	return e.EncodeWithFlags(frameType, 0, data)
+}
+
+// EncodeWithFlags is Encode setting flags, such as FLAG_COMPRESSED, on
+// every chunk.
+func (e *Encoder) EncodeWithFlags(frameType FrameType, flags byte, data []byte) (uint16, [][]byte) {
+	seq := uint16(e.sequence.Next())
+	if e.Activity != nil && frameType.IsData() {
+		e.Activity.Touch()
+	}
+
+	usable := e.FrameSize - FRAME_HEADER_SIZE
+	if usable <= 0 || len(data) <= usable {
+		frame := &Frame{Type: frameType, Seq: seq, Flags: flags | FLAG_FIN, Payload: data}
+		return seq, [][]byte{frame.Bytes()}
+	}
+
+	frames := [][]byte{}
+	for sent := 0; sent < len(data); {
+		end := sent + usable
+		if end > len(data) {
+			end = len(data)
+		}
+
+		frame := &Frame{Type: frameType, Seq: seq, Flags: flags, Payload: data[sent:end]}
+		if end == len(data) {
+			frame.Flags |= FLAG_FIN
+		}
+		frames = append(frames, frame.Bytes())
+		sent = end
+	}
+	return seq, frames
+}
+
+func NewEncoder(frameSize int) *Encoder {
+	return &Encoder{
+		FrameSize: frameSize,
+		sequence:  &Sequencer{UpperBoundBits: 16},
+	}
+}
+
+// Decoder reads frames off a connection and reassembles chunked frames
+// back into whole payloads.
+type Decoder struct {
+	// Ordered makes Decode return message and request frames in the order
+	// the peer sent them, which is the order their first chunks arrived
+	// in, rather than the order they completed in. Other frame types are
+	// never held back.
+	Ordered bool
+	// MaxFrameSize, if positive, is the largest frame, header included,
+	// ReadFrame accepts; a bigger one fails with ErrFrameTooLarge before
+	// its payload is allocated.
+	MaxFrameSize int
+	// MaxMessageSize, if positive, is the largest payload Decode
+	// reassembles; a bigger one fails with ErrMessageTooLarge before it is
+	// buffered.
+	MaxMessageSize int
+	// EventSizeLimits lowers MaxMessageSize for messages and requests on
+	// matching events, which may be patterns. Decode applies them as soon
+	// as the event name has arrived, except to compressed payloads, which
+	// are left to CheckEventSize.
+	EventSizeLimits map[string]int
+	// MaxBuffered, if positive, is the most Decode holds at once across
+	// all sequences that are being reassembled or, when Ordered, waiting
+	// for an earlier one; going past it fails with ErrBufferFull.
+	MaxBuffered int
+	// IdleTimeout, if positive, is how long ReadFrame waits for the next
+	// frame while Activity records no application traffic, before it
+	// fails with ErrIdleTimeout. ReadFrame touches Activity for every
+	// chunk carrying application data.
+	IdleTimeout time.Duration
+	Activity    *Activity
+	// ReadTimeout, if positive, is how long the rest of a frame may take
+	// to arrive once its first byte has, before ReadFrame fails with
+	// ErrReadTimeout.
+	ReadTimeout time.Duration
+	conn        deadliner
+	reader      *bufio.Reader
+	batches     map[uint16][]byte
+	limits      map[uint16]eventLimit
+	inFlight    []uint16
+	completed   map[uint16]*Frame
+	buffered    int
+}
+
+// deadliner is the part of net.Conn the Decoder needs for timeouts.
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// ReadFrame reads a single chunk as it appeared on the wire. Timeouts only
+// apply if the Decoder reads from a net.Conn.
+func (d *Decoder) ReadFrame() (*Frame, error) {
+	if err := d.awaitFrame(); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, FRAME_HEADER_SIZE)
+	if _, err := io.ReadFull(d.reader, header); err != nil {
+		return nil, timeout(err, ErrReadTimeout)
+	}
+
+	payloadLen := int(binary.BigEndian.Uint32(header[0:4]))
+	if d.MaxFrameSize > 0 && payloadLen > d.MaxFrameSize-FRAME_HEADER_SIZE {
+		return nil, ErrFrameTooLarge
+	}
+	if d.MaxMessageSize > 0 && payloadLen > d.MaxMessageSize {
+		return nil, tooLarge("", d.MaxMessageSize)
+	}
+	payload := make([]byte, payloadLen)
+	if _, err := io.ReadFull(d.reader, payload); err != nil {
+		return nil, timeout(err, ErrReadTimeout)
+	}
+
+	frame := &Frame{
+		Type:    FrameType(header[7]),
+		Seq:     binary.BigEndian.Uint16(header[4:6]),
+		Flags:   header[6],
+		Payload: payload,
+	}
+	if d.Activity != nil && frame.Type.IsData() {
+		d.Activity.Touch()
+	}
+	return frame, nil
+}
+
+// awaitFrame waits for the first byte of a frame as long as the connection
+// is not idle and then gives the rest of the frame ReadTimeout to arrive.
+func (d *Decoder) awaitFrame() error {
+	if d.conn == nil || (d.IdleTimeout <= 0 && d.ReadTimeout <= 0) {
+		return nil
+	}
+
+	if d.IdleTimeout <= 0 {
+		d.conn.SetReadDeadline(time.Time{})
+	}
+	for d.IdleTimeout > 0 {
+		idleAt := d.Activity.Last().Add(d.IdleTimeout)
+		d.conn.SetReadDeadline(idleAt)
+		_, err := d.reader.Peek(1)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			return err
+		}
+		// keep waiting if data was sent meanwhile
+		if !d.Activity.Last().Add(d.IdleTimeout).After(idleAt) {
+			return ErrIdleTimeout
+		}
+	}
+
+	var deadline time.Time
+	if d.ReadTimeout > 0 {
+		if _, err := d.reader.Peek(1); err != nil {
+			return err
+		}
+		deadline = time.Now().Add(d.ReadTimeout)
+	}
+	d.conn.SetReadDeadline(deadline)
+	return nil
+}
+
+// timeout replaces err with cause if err is a read deadline expiring.
+func timeout(err, cause error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return cause
+	}
+	return err
+}
+
+// Decode blocks until a whole frame has been received, buffering the chunks
+// of any other sequences that arrive interleaved with it.
+func (d *Decoder) Decode() (*Frame, error) {
+	for {
+		if frame := d.nextCompleted(); frame != nil {
+			return frame, nil
+		}
+
+		frame, err := d.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		batch, buffered := d.batches[frame.Seq]
+		if err := d.checkSize(frame, batch); err != nil {
+			return nil, err
+		}
+		ordered := d.Ordered && (frame.Type == FRAME_TYPE_MESSAGE || frame.Type == FRAME_TYPE_REQUEST)
+		if ordered && !buffered {
+			d.inFlight = append(d.inFlight, frame.Seq)
+		}
+		if !frame.Last() {
+			if err := d.hold(len(frame.Payload)); err != nil {
+				return nil, err
+			}
+			d.batches[frame.Seq] = append(batch, frame.Payload...)
+			continue
+		}
+
+		if buffered {
+			d.buffered -= len(batch)
+			frame.Payload = append(batch, frame.Payload...)
+			delete(d.batches, frame.Seq)
+			delete(d.limits, frame.Seq)
+		}
+		if ordered && d.inFlight[0] != frame.Seq {
+			if err := d.hold(len(frame.Payload)); err != nil {
+				return nil, err
+			}
+			d.completed[frame.Seq] = frame
+			continue
+		}
+		if ordered {
+			d.inFlight = d.inFlight[1:]
+		}
+		return frame, nil
+	}
+}
+
+// hold accounts for size more bytes being kept back, failing if that takes
+// the Decoder past MaxBuffered.
+func (d *Decoder) hold(size int) error {
+	if d.MaxBuffered > 0 && d.buffered+size > d.MaxBuffered {
+		return fmt.Errorf("%w of %v bytes", ErrBufferFull, d.MaxBuffered)
+	}
+	d.buffered += size
+	return nil
+}
+
+// checkSize fails if frame would take its sequence past its size limit,
+// remembering the limit once the event it applies to is known.
+func (d *Decoder) checkSize(frame *Frame, batch []byte) error {
+	size := len(batch) + len(frame.Payload)
+	if len(d.EventSizeLimits) == 0 || frame.Compressed() {
+		if d.MaxMessageSize > 0 && size > d.MaxMessageSize {
+			return tooLarge("", d.MaxMessageSize)
+		}
+		return nil
+	}
+
+	limit, ok := d.limits[frame.Seq]
+	if !ok {
+		limit.size = d.MaxMessageSize
+		if event, found := eventOf(frame.Type, batch, frame.Payload); found {
+			limit = eventLimit{event: event, size: SizeLimitFor(d.MaxMessageSize, d.EventSizeLimits, event)}
+			if !frame.Last() {
+				d.limits[frame.Seq] = limit
+			}
+		}
+	}
+	if limit.size > 0 && size > limit.size {
+		return tooLarge(limit.event, limit.size)
+	}
+	return nil
+}
+
+// CheckEventSize applies EventSizeLimits to a whole message or request
+// frame, for payloads Decode could not check because they were compressed.
+func (d *Decoder) CheckEventSize(frame *Frame) error {
+	if len(d.EventSizeLimits) == 0 {
+		return nil
+	}
+
+	event, ok := eventOf(frame.Type, frame.Payload, nil)
+	if !ok {
+		return nil
+	}
+	if limit := SizeLimitFor(d.MaxMessageSize, d.EventSizeLimits, event); limit > 0 && len(frame.Payload) > limit {
+		return tooLarge(event, limit)
+	}
+	return nil
+}
+
+// nextCompleted returns the oldest ordered frame if it has completed.
+func (d *Decoder) nextCompleted() *Frame {
+	if len(d.inFlight) == 0 {
+		return nil
+	}
+
+	frame, ok := d.completed[d.inFlight[0]]
+	if !ok {
+		return nil
+	}
+	delete(d.completed, d.inFlight[0])
+	d.inFlight = d.inFlight[1:]
+	d.buffered -= len(frame.Payload)
+	return frame
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	conn, _ := r.(deadliner)
+	return &Decoder{
+		conn:      conn,
+		reader:    bufio.NewReader(r),
+		batches:   map[uint16][]byte{},
+		limits:    map[uint16]eventLimit{},
+		completed: map[uint16]*Frame{},
+	}
+}
@@ -0,0 +1,241 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+
+	"go-sockets/compress"
+)
+
+// chunks encodes each payload as a message and returns the frames of
+// each.
+func chunks(e *Encoder, payloads ...string) [][][]byte {
+	var encoded [][][]byte
+	for _, payload := range payloads {
+		_, frames := e.Encode(FRAME_TYPE_MESSAGE, []byte(payload))
+		encoded = append(encoded, frames)
+	}
+	return encoded
+}
+
+// decodeAll decodes frames until the input runs out and returns their
+// payloads in the order Decode returned them.
+func decodeAll(t *testing.T, d *Decoder) []string {
+	t.Helper()
+
+	var got []string
+	for {
+		frame, err := d.Decode()
+		if errors.Is(err, io.EOF) {
+			return got
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(frame.Payload))
+	}
+}
+
+func TestDecoderOrdered(t *testing.T) {
+	tests := []struct {
+		name    string
+		ordered bool
+		want    []string
+	}{
+		// the heartbeat is returned as soon as it arrives, while beta
+		// and gamma wait for alpha
+		{"ordered", true, []string{"hb", "alpha-alpha-alpha", "beta", "gamma-gamma"}},
+		{"unordered", false, []string{"beta", "hb", "gamma-gamma", "alpha-alpha-alpha"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoder := NewEncoder(FRAME_HEADER_SIZE + 6)
+			m := chunks(encoder, "alpha-alpha-alpha", "beta", "gamma-gamma")
+			_, heartbeat := encoder.Encode(FRAME_TYPE_HEARTBEAT, []byte("hb"))
+
+			// alpha starts first but finishes last, with a heartbeat in
+			// between that must not wait for it
+			var wire bytes.Buffer
+			for _, frame := range [][]byte{m[0][0], m[1][0], m[2][0], heartbeat[0], m[2][1], m[0][1], m[0][2]} {
+				wire.Write(frame)
+			}
+
+			decoder := NewDecoder(&wire)
+			decoder.Ordered = test.ordered
+			got := decodeAll(t, decoder)
+
+			if strings.Join(got, ",") != strings.Join(test.want, ",") {
+				t.Fatalf("Decoded %v, want %v", got, test.want)
+			}
+			if decoder.buffered != 0 {
+				t.Fatalf("Decoder still accounts for %v buffered bytes", decoder.buffered)
+			}
+		})
+	}
+}
+
+func TestDecoderOrderedSequenceWraparound(t *testing.T) {
+	encoder := NewEncoder(FRAME_HEADER_SIZE + 4)
+	// the next sequences are 65534, then 0 and 1 as 65535 is skipped
+	encoder.sequence.current = 1<<16 - 2
+	m := chunks(encoder, "first-one", "second", "third")
+
+	var seqs []uint16
+	for _, frames := range m {
+		seqs = append(seqs, binary.BigEndian.Uint16(frames[0][4:6]))
+	}
+	if seqs[0] != 65534 || seqs[1] != 0 || seqs[2] != 1 {
+		t.Fatalf("Encoder used sequences %v, want [65534 0 1]", seqs)
+	}
+
+	// the sequences after the wraparound complete before the one that
+	// started ahead of them
+	var wire bytes.Buffer
+	for _, frame := range [][]byte{m[0][0], m[1][0], m[2][0], m[1][1], m[2][1], m[0][1], m[0][2]} {
+		wire.Write(frame)
+	}
+
+	decoder := NewDecoder(&wire)
+	decoder.Ordered = true
+	got := decodeAll(t, decoder)
+
+	want := []string{"first-one", "second", "third"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("Decoded %v, want %v", got, want)
+	}
+}
+
+func TestDecoderMaxBuffered(t *testing.T) {
+	encoder := NewEncoder(FRAME_HEADER_SIZE + 4)
+	m := chunks(encoder, "aaaaaaaaaa", "bbbbbbbbbb")
+
+	var wire bytes.Buffer
+	for _, frame := range [][]byte{m[0][0], m[1][0], m[0][1], m[1][1], m[0][2], m[1][2]} {
+		wire.Write(frame)
+	}
+
+	decoder := NewDecoder(&wire)
+	decoder.MaxBuffered = 12
+	_, err := decoder.Decode()
+	if !errors.Is(err, ErrBufferFull) {
+		t.Fatalf("Decode returned %v, want ErrBufferFull", err)
+	}
+}
+
+func TestDecoderFrameTooLarge(t *testing.T) {
+	// a header announcing a gigabyte, with none of it following
+	header := (&Frame{Type: FRAME_TYPE_MESSAGE, Flags: FLAG_FIN}).Bytes()
+	binary.BigEndian.PutUint32(header, 1<<30)
+
+	decoder := NewDecoder(bytes.NewReader(header))
+	decoder.MaxFrameSize = FRAME_SIZE
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := decoder.Decode()
+	runtime.ReadMemStats(&after)
+
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("Decode returned %v, want ErrFrameTooLarge", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 64*1024 {
+		t.Fatalf("Decode allocated %v bytes for a frame it rejected", allocated)
+	}
+}
+
+func TestDecoderMessageTooLarge(t *testing.T) {
+	encoder := NewEncoder(FRAME_HEADER_SIZE + 16)
+	payload, _ := EncodeMessage(0, "big", bytes.Repeat([]byte("x"), 100))
+	_, frames := encoder.Encode(FRAME_TYPE_MESSAGE, payload)
+
+	var wire bytes.Buffer
+	for _, frame := range frames {
+		wire.Write(frame)
+	}
+
+	decoder := NewDecoder(&wire)
+	decoder.MaxMessageSize = 50
+	_, err := decoder.Decode()
+	if !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("Decode returned %v, want ErrMessageTooLarge", err)
+	}
+	// the chunk going over the limit is rejected before it is buffered
+	if held := len(decoder.batches[0]); held > 50 {
+		t.Fatalf("Decoder buffered %v bytes of a message limited to 50", held)
+	}
+}
+
+func TestDecoderEventSizeLimits(t *testing.T) {
+	tests := []struct {
+		event string
+		fails bool
+	}{
+		{"uploads.avatar", true},
+		// the name alone spans several chunks before the limit is known
+		{"uploads.some-rather-long-name", true},
+		{"chat", false},
+	}
+	for _, test := range tests {
+		t.Run(test.event, func(t *testing.T) {
+			encoder := NewEncoder(FRAME_HEADER_SIZE + 8)
+			payload, _ := EncodeMessage(0, test.event, bytes.Repeat([]byte("x"), 64))
+			_, frames := encoder.Encode(FRAME_TYPE_MESSAGE, payload)
+
+			var wire bytes.Buffer
+			for _, frame := range frames {
+				wire.Write(frame)
+			}
+
+			decoder := NewDecoder(&wire)
+			decoder.MaxMessageSize = 1024
+			decoder.EventSizeLimits = map[string]int{"uploads.*": 48}
+			_, err := decoder.Decode()
+			if test.fails && !errors.Is(err, ErrMessageTooLarge) {
+				t.Fatalf("Decode returned %v, want ErrMessageTooLarge", err)
+			}
+			if !test.fails && err != nil {
+				t.Fatalf("Decode returned %v for an event without a limit", err)
+			}
+		})
+	}
+}
+
+func TestDecoderCheckEventSizeCompressed(t *testing.T) {
+	compression := &Compression{Compressor: compress.Deflate{}}
+	limits := map[string]int{"uploads.*": 48}
+
+	for _, event := range []string{"uploads.avatar", "chat"} {
+		payload, _ := EncodeMessage(0, event, bytes.Repeat([]byte("x"), 1024))
+		compressed, flags, err := compression.Compress(payload)
+		if err != nil || flags != FLAG_COMPRESSED {
+			t.Fatalf("Compress returned flags %v, %v", flags, err)
+		}
+		_, frames := NewEncoder(FRAME_SIZE).EncodeWithFlags(FRAME_TYPE_MESSAGE, flags, compressed)
+
+		decoder := NewDecoder(bytes.NewReader(frames[0]))
+		decoder.MaxMessageSize = 4096
+		decoder.EventSizeLimits = limits
+
+		// the limits cannot be applied to the compressed bytes
+		frame, err := decoder.Decode()
+		if err != nil {
+			t.Fatalf("Decode returned %v for a compressed frame", err)
+		}
+		if frame.Payload, err = compression.Decompress(frame.Payload); err != nil {
+			t.Fatal(err)
+		}
+
+		err = decoder.CheckEventSize(frame)
+		if event == "chat" && err != nil {
+			t.Fatalf("CheckEventSize returned %v for an event without a limit", err)
+		}
+		if event != "chat" && !errors.Is(err, ErrMessageTooLarge) {
+			t.Fatalf("CheckEventSize returned %v, want ErrMessageTooLarge", err)
+		}
+	}
+}
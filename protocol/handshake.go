@@ -0,0 +1,152 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Version 2 added the codec id to message payloads.
+const (
+	PROTOCOL_VERSION     uint16 = 2
+	MIN_PROTOCOL_VERSION uint16 = 2
+	HANDSHAKE_SIZE       int    = 14
+)
+
+// HANDSHAKE_TIMEOUT is how long either side waits for the other's
+// handshake frame, and how long a TLS server waits for the TLS handshake
+// before that.
+const HANDSHAKE_TIMEOUT = time.Second * 10
+
+const (
+	FEATURE_COMPRESSION uint32 = 1 << 0
+	FEATURE_ACKS        uint32 = 1 << 1
+	FEATURE_AUTH        uint32 = 1 << 2
+	FEATURE_STREAM_FLOW uint32 = 1 << 3
+)
+
+// SUPPORTED_FEATURES is the set of features this implementation can speak.
+// A server only accepts FEATURE_AUTH if it requires authentication.
+// FEATURE_COMPRESSION is only offered by sides with compressors configured.
+const SUPPORTED_FEATURES uint32 = FEATURE_COMPRESSION | FEATURE_ACKS | FEATURE_AUTH | FEATURE_STREAM_FLOW
+
+var ErrMalformedHandshake = errors.New("Malformed handshake frame")
+
+// Handshake is the payload of a FRAME_TYPE_READY frame. The client sends
+// its offer right after connecting and the server answers with the subset
+// it accepted; no other frames may be sent before that exchange completes.
+//
+//	| version uint16 | features uint32 | max frame size uint32 | heartbeat interval uint32 |
+//	| compressor count byte | compressor ids ... |
+//
+// The heartbeat interval, in milliseconds, and the compressors were
+// appended later; peers that leave them out are treated as having no
+// preference and no compressors. The client lists the compressors it
+// supports in order of preference and the server answers with the one it
+// picked.
+type Handshake struct {
+	Version           uint16
+	Features          uint32
+	MaxFrameSize      uint32
+	HeartbeatInterval uint32
+	Compressors       []byte
+}
+
+func (h *Handshake) Has(feature uint32) bool {
+	return h.Features&feature == feature
+}
+
+func (h *Handshake) Bytes() []byte {
+	buff := make([]byte, HANDSHAKE_SIZE, HANDSHAKE_SIZE+1+len(h.Compressors))
+	binary.BigEndian.PutUint16(buff[0:2], h.Version)
+	binary.BigEndian.PutUint32(buff[2:6], h.Features)
+	binary.BigEndian.PutUint32(buff[6:10], h.MaxFrameSize)
+	binary.BigEndian.PutUint32(buff[10:14], h.HeartbeatInterval)
+	buff = append(buff, byte(len(h.Compressors)))
+	return append(buff, h.Compressors...)
+}
+
+// Negotiate answers a peer's offer with the highest common version, the
+// features both sides support, the smaller of the two frame sizes, the
+// shorter of the two heartbeat intervals that were given, but no shorter
+// than MIN_HEARTBEAT_INTERVAL, and the first compressor in the offer that both
+// sides know. Compression is dropped if there is none.
+func (h *Handshake) Negotiate(offer *Handshake) (*Handshake, error) {
+	if offer.Version < MIN_PROTOCOL_VERSION {
+		return nil, fmt.Errorf("Unsupported protocol version %v, minimum is %v", offer.Version, MIN_PROTOCOL_VERSION)
+	}
+
+	accepted := &Handshake{
+		Version:           h.Version,
+		Features:          h.Features & offer.Features,
+		MaxFrameSize:      h.MaxFrameSize,
+		HeartbeatInterval: h.HeartbeatInterval,
+	}
+	if offer.Version < accepted.Version {
+		accepted.Version = offer.Version
+	}
+	if offer.MaxFrameSize != 0 && offer.MaxFrameSize < uint32(MIN_FRAME_SIZE) {
+		return nil, fmt.Errorf("Frame size %v is below the minimum of %v", offer.MaxFrameSize, MIN_FRAME_SIZE)
+	}
+	if offer.MaxFrameSize != 0 && offer.MaxFrameSize < accepted.MaxFrameSize {
+		accepted.MaxFrameSize = offer.MaxFrameSize
+	}
+	if accepted.HeartbeatInterval == 0 || offer.HeartbeatInterval != 0 && offer.HeartbeatInterval < accepted.HeartbeatInterval {
+		accepted.HeartbeatInterval = offer.HeartbeatInterval
+	}
+	if floor := uint32(MIN_HEARTBEAT_INTERVAL.Milliseconds()); accepted.HeartbeatInterval != 0 && accepted.HeartbeatInterval < floor {
+		accepted.HeartbeatInterval = floor
+	}
+	if accepted.Has(FEATURE_COMPRESSION) {
+		accepted.Features &^= FEATURE_COMPRESSION
+		for _, id := range offer.Compressors {
+			if bytes.IndexByte(h.Compressors, id) >= 0 {
+				accepted.Features |= FEATURE_COMPRESSION
+				accepted.Compressors = []byte{id}
+				break
+			}
+		}
+	}
+	return accepted, nil
+}
+
+func DecodeHandshake(payload []byte) (*Handshake, error) {
+	if len(payload) < 10 {
+		return nil, ErrMalformedHandshake
+	}
+
+	h := &Handshake{
+		Version:      binary.BigEndian.Uint16(payload[0:2]),
+		Features:     binary.BigEndian.Uint32(payload[2:6]),
+		MaxFrameSize: binary.BigEndian.Uint32(payload[6:10]),
+	}
+	if len(payload) >= HANDSHAKE_SIZE {
+		h.HeartbeatInterval = binary.BigEndian.Uint32(payload[10:14])
+	}
+	if len(payload) > HANDSHAKE_SIZE {
+		count := int(payload[HANDSHAKE_SIZE])
+		if len(payload) < HANDSHAKE_SIZE+1+count {
+			return nil, ErrMalformedHandshake
+		}
+		h.Compressors = payload[HANDSHAKE_SIZE+1 : HANDSHAKE_SIZE+1+count]
+	}
+	return h, nil
+}
+
+// NewHandshake offers every supported feature, leaving out
+// FEATURE_COMPRESSION if there are no compressors.
+func NewHandshake(maxFrameSize int, heartbeatInterval time.Duration, compressors []byte) *Handshake {
+	h := &Handshake{
+		Version:           PROTOCOL_VERSION,
+		Features:          SUPPORTED_FEATURES,
+		MaxFrameSize:      uint32(maxFrameSize),
+		HeartbeatInterval: uint32(heartbeatInterval.Milliseconds()),
+		Compressors:       compressors,
+	}
+	if len(compressors) == 0 {
+		h.Features &^= FEATURE_COMPRESSION
+	}
+	return h
+}
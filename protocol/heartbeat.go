@@ -0,0 +1,115 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+const DEFAULT_MISSED_HEARTBEATS int = 3
+
+// MIN_HEARTBEAT_INTERVAL is the shortest heartbeat interval either side
+// may ask for.
+const MIN_HEARTBEAT_INTERVAL = 10 * time.Millisecond
+
+// HEARTBEAT_SIZE is the size of a heartbeat's payload, the time it was
+// sent in nanoseconds.
+const HEARTBEAT_SIZE int = 8
+
+var (
+	ErrHeartbeatTimeout   = errors.New("Peer missed too many heartbeats")
+	ErrMalformedHeartbeat = errors.New("Malformed heartbeat frame")
+)
+
+// Keepalive sends heartbeats on a connection and watches for the peer
+// going silent. Every heartbeat carries its send time, which the peer
+// echoes in its HEARTBEAT_ACK to measure the round trip.
+type Keepalive struct {
+	Interval time.Duration
+	// MaxMissed is how many intervals may pass without hearing anything
+	// from the peer before it is considered dead.
+	MaxMissed int
+	lastSeen  atomic.Int64
+	latency   atomic.Int64
+	holds     atomic.Int32
+}
+
+// Seen records that something arrived from the peer.
+func (k *Keepalive) Seen() {
+	k.lastSeen.Store(time.Now().UnixNano())
+}
+
+// Hold keeps Run from taking the time until release is called for the
+// peer going silent, for while the connection stops reading frames of its
+// own accord.
+func (k *Keepalive) Hold() (release func()) {
+	k.holds.Add(1)
+	return func() {
+		k.Seen()
+		k.holds.Add(-1)
+	}
+}
+
+// CheckHeartbeat fails with ErrMalformedHeartbeat unless payload is a
+// send time, the only thing a heartbeat may carry and be echoed with.
+func CheckHeartbeat(payload []byte) error {
+	if len(payload) != HEARTBEAT_SIZE {
+		return ErrMalformedHeartbeat
+	}
+	return nil
+}
+
+// Ack records the round trip of a heartbeat echoed in payload, ignoring
+// payloads that are not a send time.
+func (k *Keepalive) Ack(payload []byte) {
+	if CheckHeartbeat(payload) != nil {
+		return
+	}
+	sent := int64(binary.BigEndian.Uint64(payload))
+	k.latency.Store(time.Now().UnixNano() - sent)
+}
+
+// Latency is the round trip time of the last acknowledged heartbeat, or 0
+// if none has been acknowledged yet.
+func (k *Keepalive) Latency() time.Duration {
+	return time.Duration(k.latency.Load())
+}
+
+// Run sends a heartbeat every Interval until done is closed, returning
+// ErrHeartbeatTimeout once the peer has been silent for MaxMissed
+// intervals, or the error of a heartbeat that could not be sent. Without
+// a positive Interval it sends nothing and only waits for done.
+func (k *Keepalive) Run(done <-chan struct{}, send func(payload []byte) error) error {
+	if k.Interval <= 0 {
+		<-done
+		return nil
+	}
+
+	ticker := time.NewTicker(k.Interval)
+	defer ticker.Stop()
+
+	for {
+		if k.holds.Load() == 0 && time.Since(time.Unix(0, k.lastSeen.Load())) > k.Interval*time.Duration(k.MaxMissed) {
+			return ErrHeartbeatTimeout
+		}
+
+		payload := make([]byte, HEARTBEAT_SIZE)
+		binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+		if err := send(payload); err != nil {
+			return err
+		}
+
+		select {
+		case <-done:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func NewKeepalive(interval time.Duration, maxMissed int) *Keepalive {
+	k := &Keepalive{Interval: interval, MaxMissed: maxMissed}
+	k.Seen()
+	return k
+}
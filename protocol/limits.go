@@ -0,0 +1,83 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// DEFAULT_MAX_MESSAGE_SIZE is the largest message either side accepts
+	// unless configured otherwise.
+	DEFAULT_MAX_MESSAGE_SIZE int = 16 * 1024 * 1024
+	// MAX_BUFFERED_MESSAGES is how many messages of the maximum size a
+	// Decoder may hold back at once while reassembling interleaved ones.
+	MAX_BUFFERED_MESSAGES int = 4
+)
+
+// eventLimit is the size limit of a sequence carrying event.
+type eventLimit struct {
+	event string
+	size  int
+}
+
+// SizeLimitFor returns the most a payload on event may hold: the smallest
+// of max and the limits of every entry in events matching event, which may
+// be patterns. 0 means no limit.
+func SizeLimitFor(max int, events map[string]int, event string) int {
+	limit := max
+	for pattern, size := range events {
+		if (limit == 0 || size < limit) && (pattern == event || MatchEvent(pattern, event)) {
+			limit = size
+		}
+	}
+	return limit
+}
+
+// eventOffset is where the message starts in the payload of a message or
+// request frame, or -1 for other frame types.
+func eventOffset(frameType FrameType) int {
+	switch frameType {
+	case FRAME_TYPE_MESSAGE:
+		return 0
+	case FRAME_TYPE_REQUEST:
+		return 4
+	default:
+		return -1
+	}
+}
+
+// eventOf returns the event named at the start of a message or request
+// payload split across head and tail, or false if not enough of it is
+// there yet.
+func eventOf(frameType FrameType, head, tail []byte) (string, bool) {
+	offset := eventOffset(frameType)
+	if offset < 0 {
+		return "", false
+	}
+
+	size := len(head) + len(tail)
+	if size < offset+3 {
+		return "", false
+	}
+	end := offset + 3 + int(binary.BigEndian.Uint16(prefix(head, tail, offset+3)[offset+1:]))
+	if size < end {
+		return "", false
+	}
+	return string(prefix(head, tail, end)[offset+3:]), true
+}
+
+// prefix returns the first n bytes of head followed by tail, copying only
+// if they span both.
+func prefix(head, tail []byte, n int) []byte {
+	if len(head) >= n {
+		return head[:n]
+	}
+	return append(head[:len(head):len(head)], tail[:n-len(head)]...)
+}
+
+func tooLarge(event string, limit int) error {
+	if event == "" {
+		return fmt.Errorf("%w of %v bytes", ErrMessageTooLarge, limit)
+	}
+	return fmt.Errorf("%w of %v bytes for event %v", ErrMessageTooLarge, limit, event)
+}
@@ -0,0 +1,271 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// MessageHandler receives the data of an event.
+type MessageHandler func(data string)
+
+// RequestHandler answers a request; what it returns is sent back as the
+// reply.
+type RequestHandler func(data string) ([]byte, error)
+
+// StreamHandler reads a stream the peer opened.
+type StreamHandler func(r io.Reader)
+
+// AnyHandler receives an event along with its name.
+type AnyHandler func(event, data string)
+
+type listener struct {
+	id      uint64
+	event   string
+	handler func(msg *Message)
+	once    bool
+	fired   atomic.Bool
+}
+
+// Subscription is a handler registered with On, Once or OnMessage.
+type Subscription struct {
+	listeners *Listeners
+	event     string
+	id        uint64
+}
+
+// Event returns the name or pattern the handler was registered for.
+func (sub *Subscription) Event() string {
+	return sub.event
+}
+
+// Off removes the handler, like socket.Off(sub.Event(), sub).
+func (sub *Subscription) Off() {
+	sub.listeners.Off(sub.event, sub)
+}
+
+// Listeners holds the handlers a socket runs for incoming events, requests
+// and streams. It is safe for concurrent use and its zero value is ready
+// to use; the server's and the client's sockets embed it.
+type Listeners struct {
+	events    map[string][]*listener
+	patterns  map[string][]*listener
+	requests  map[string]RequestHandler
+	streams   map[string]StreamHandler
+	anyEvent  AnyHandler
+	unhandled AnyHandler
+	next      uint64
+	mutex     sync.RWMutex
+}
+
+// On registers callback for event, which may also be a pattern such as
+// "orders.*" or "**" as described by MatchEvent.
+// Handlers are added to those already registered for event; the returned
+// subscription removes just this one.
+func (l *Listeners) On(event string, callback MessageHandler) *Subscription {
+	return l.add(event, false, func(msg *Message) {
+		callback(string(msg.Data))
+	})
+}
+
+// Once registers callback for event like On, but removes it after it ran
+// once.
+func (l *Listeners) Once(event string, callback MessageHandler) *Subscription {
+	return l.add(event, true, func(msg *Message) {
+		callback(string(msg.Data))
+	})
+}
+
+// OnMessage is On for handlers that need the whole message, such as the
+// codec its data was encoded with.
+func (l *Listeners) OnMessage(event string, handler func(msg *Message)) *Subscription {
+	return l.add(event, false, handler)
+}
+
+func (l *Listeners) add(event string, once bool, handler func(msg *Message)) *Subscription {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.events == nil {
+		l.events = map[string][]*listener{}
+		l.patterns = map[string][]*listener{}
+	}
+
+	l.next++
+	entry := &listener{id: l.next, event: event, handler: handler, once: once}
+	if IsPattern(event) {
+		l.patterns[event] = append(l.patterns[event], entry)
+	} else {
+		l.events[event] = append(l.events[event], entry)
+	}
+	return &Subscription{listeners: l, event: event, id: entry.id}
+}
+
+// OnRequest registers a handler whose return value is sent back to the peer
+// as the reply to a Request on event.
+func (l *Listeners) OnRequest(event string, callback RequestHandler) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.requests == nil {
+		l.requests = map[string]RequestHandler{}
+	}
+	l.requests[event] = callback
+}
+
+// OnStream registers a handler for streams the peer opens on event. The
+// reader yields the stream's content as it arrives and returns io.EOF once
+// the peer closes it. Up to STREAM_WINDOW bytes of every stream are
+// buffered; the peer then waits for the handler to catch up, without
+// holding up the rest of the connection. Peers that do not support flow
+// control make the connection stop reading instead. Anything left unread
+// when the handler returns is discarded and the peer told to stop sending.
+func (l *Listeners) OnStream(event string, callback StreamHandler) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.streams == nil {
+		l.streams = map[string]StreamHandler{}
+	}
+	l.streams[event] = callback
+}
+
+// OnAny sets a handler that sees every event before its own handlers run,
+// whether or not any are registered.
+func (l *Listeners) OnAny(callback AnyHandler) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.anyEvent = callback
+}
+
+// OnUnhandled sets a handler for events that neither a name nor a pattern
+// registered with On matches.
+func (l *Listeners) OnUnhandled(callback AnyHandler) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.unhandled = callback
+}
+
+// Off removes the given subscriptions to event or, if there are none, every
+// handler registered for event with On, Once, OnMessage, OnRequest or
+// OnStream.
+func (l *Listeners) Off(event string, subscriptions ...*Subscription) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if len(subscriptions) > 0 {
+		for _, subscription := range subscriptions {
+			if subscription.event == event {
+				l.remove(event, subscription.id)
+			}
+		}
+		return
+	}
+
+	delete(l.events, event)
+	delete(l.patterns, event)
+	delete(l.requests, event)
+	delete(l.streams, event)
+}
+
+// remove unregisters the handler with the given id. The caller must hold
+// mutex.
+func (l *Listeners) remove(event string, id uint64) {
+	listeners := l.events
+	if IsPattern(event) {
+		listeners = l.patterns
+	}
+
+	for i, entry := range listeners[event] {
+		if entry.id != id {
+			continue
+		}
+
+		remaining := append(append([]*listener(nil), listeners[event][:i]...), listeners[event][i+1:]...)
+		if len(remaining) == 0 {
+			delete(listeners, event)
+		} else {
+			listeners[event] = remaining
+		}
+		return
+	}
+}
+
+// Envoke runs the OnAny handler and then the handlers for msg: those
+// registered for its exact name followed by those of every matching
+// pattern, or the OnUnhandled handler if there are none.
+func (l *Listeners) Envoke(msg *Message) {
+	l.mutex.RLock()
+	handlers := append([]*listener(nil), l.events[msg.Event]...)
+	for pattern, listeners := range l.patterns {
+		if MatchEvent(pattern, msg.Event) {
+			handlers = append(handlers, listeners...)
+		}
+	}
+	anyEvent, unhandled := l.anyEvent, l.unhandled
+	l.mutex.RUnlock()
+
+	if anyEvent != nil {
+		anyEvent(msg.Event, string(msg.Data))
+	}
+	for _, entry := range handlers {
+		l.fire(entry, msg)
+	}
+	if len(handlers) == 0 && unhandled != nil {
+		unhandled(msg.Event, string(msg.Data))
+	}
+}
+
+// Handlers returns the handlers registered for exactly event, leaving out
+// patterns and OnAny, for events a socket raises itself such as
+// "connection".
+func (l *Listeners) Handlers(event string) []func(msg *Message) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	handlers := make([]func(msg *Message), 0, len(l.events[event]))
+	for _, entry := range l.events[event] {
+		entry := entry
+		handlers = append(handlers, func(msg *Message) {
+			l.fire(entry, msg)
+		})
+	}
+	return handlers
+}
+
+// fire runs entry, unregistering it first if it is a one-shot handler that
+// has not fired yet.
+func (l *Listeners) fire(entry *listener, msg *Message) {
+	if entry.once {
+		if !entry.fired.CompareAndSwap(false, true) {
+			return
+		}
+		l.mutex.Lock()
+		l.remove(entry.event, entry.id)
+		l.mutex.Unlock()
+	}
+	entry.handler(msg)
+}
+
+// HandleRequest runs the handler registered for a request on msg.Event and
+// returns its reply.
+func (l *Listeners) HandleRequest(msg *Message) ([]byte, error) {
+	l.mutex.RLock()
+	handler, ok := l.requests[msg.Event]
+	l.mutex.RUnlock()
+
+	if !ok {
+		return nil, errors.New("No request handler registered for event " + msg.Event)
+	}
+	return handler(string(msg.Data))
+}
+
+// StreamHandlerFor returns the handler for streams opened on event.
+func (l *Listeners) StreamHandlerFor(event string) (StreamHandler, bool) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	handler, ok := l.streams[event]
+	return handler, ok
+}
@@ -0,0 +1,55 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	MAX_EVENT_NAME_SIZE int = 1<<16 - 2
+)
+
+var ErrMalformedMessage = errors.New("Malformed message frame")
+
+// Message is the payload of a FRAME_TYPE_MESSAGE frame:
+//
+//	| codec id byte | event length uint16 | event name | data ... |
+//
+// where the codec id tells the receiver how data was serialised (see the
+// codec package); 0 means raw bytes.
+type Message struct {
+	Codec byte
+	Event string
+	Data  []byte
+}
+
+func EncodeMessage(codec byte, event string, data []byte) ([]byte, error) {
+	if len(event) > MAX_EVENT_NAME_SIZE {
+		return nil, fmt.Errorf("Event Name length exceeds the maximum of %v bytes", MAX_EVENT_NAME_SIZE)
+	}
+
+	payload := make([]byte, 3, 3+len(event)+len(data))
+	payload[0] = codec
+	binary.BigEndian.PutUint16(payload[1:3], uint16(len(event)))
+	payload = append(payload, event...)
+	payload = append(payload, data...)
+	return payload, nil
+}
+
+func DecodeMessage(payload []byte) (*Message, error) {
+	if len(payload) < 3 {
+		return nil, ErrMalformedMessage
+	}
+
+	eventEnd := 3 + int(binary.BigEndian.Uint16(payload[1:3]))
+	if eventEnd > len(payload) {
+		return nil, ErrMalformedMessage
+	}
+
+	return &Message{
+		Codec: payload[0],
+		Event: string(payload[3:eventEnd]),
+		Data:  payload[eventEnd:],
+	}, nil
+}
@@ -0,0 +1,41 @@
+package protocol
+
+import "strings"
+
+// IsPattern reports whether event contains wildcards.
+func IsPattern(event string) bool {
+	return strings.Contains(event, "*")
+}
+
+// MatchEvent reports whether event matches pattern. Event names are split
+// into segments at dots; in a pattern "*" matches exactly one segment and
+// "**" any number of them, including none. So "orders.*" matches
+// "orders.created" but not "orders.eu.created", which "orders.**" does,
+// and "**" matches everything.
+func MatchEvent(pattern, event string) bool {
+	return matchSegments(strings.Split(pattern, "."), strings.Split(event, "."))
+}
+
+func matchSegments(pattern, event []string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case "**":
+			for i := 0; i <= len(event); i++ {
+				if matchSegments(pattern[1:], event[i:]) {
+					return true
+				}
+			}
+			return false
+		case "*":
+			if len(event) == 0 {
+				return false
+			}
+		default:
+			if len(event) == 0 || pattern[0] != event[0] {
+				return false
+			}
+		}
+		pattern, event = pattern[1:], event[1:]
+	}
+	return len(event) == 0
+}
@@ -0,0 +1,257 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+type OverflowPolicy int
+
+const (
+	// OVERFLOW_BLOCK makes senders wait until the writer catches up.
+	OVERFLOW_BLOCK OverflowPolicy = iota
+	// OVERFLOW_DROP_OLDEST discards the oldest queued message that has not
+	// been handed to the writer yet, blocking if there is none.
+	OVERFLOW_DROP_OLDEST
+	// OVERFLOW_ERROR fails the send with ErrQueueFull.
+	OVERFLOW_ERROR
+)
+
+const (
+	DEFAULT_HIGH_WATER_MARK int = 4 * 1024 * 1024
+)
+
+var ErrQueueFull = errors.New("Send queue is full")
+
+// Outgoing is an encoded message waiting to be written.
+type Outgoing struct {
+	Seq    uint16
+	Frames [][]byte
+	next   int
+	pinned bool
+}
+
+func (o *Outgoing) Size() int {
+	size := 0
+	for _, frame := range o.Frames {
+		size += len(frame)
+	}
+	return size
+}
+
+// SendQueue is a bounded outbound queue drained by a single writer. Bytes
+// count against the high-water mark from Push until the writer Releases
+// them, so a slow peer pushes back on producers instead of piling up memory.
+// A message larger than the high-water mark is still accepted when the
+// queue is otherwise empty.
+//
+// The writer takes one frame from each queued message in turn, so a large
+// message does not hold up the small ones queued behind it. Messages are
+// dropped from the queue as soon as their last frame has been taken.
+type SendQueue struct {
+	highWaterMark int
+	policy        OverflowPolicy
+	messages      []*Outgoing
+	turn          int
+	queued        int
+	closed        bool
+	mutex         sync.Mutex
+	cond          *sync.Cond
+}
+
+func (q *SendQueue) Push(msg *Outgoing) error {
+	return q.push(msg, q.policy)
+}
+
+// PushBlocking is Push with the OVERFLOW_BLOCK policy, for messages that
+// must not be dropped, such as stream chunks and responses.
+// OVERFLOW_DROP_OLDEST never drops them later either.
+func (q *SendQueue) PushBlocking(msg *Outgoing) error {
+	msg.pinned = true
+	return q.push(msg, OVERFLOW_BLOCK)
+}
+
+// PushControl queues a frame that keeps the connection itself going, such
+// as a heartbeat or a close frame. It goes past the high-water mark instead
+// of waiting for room, so it never blocks, and is never dropped. It is
+// only for small frames this side sends of its own accord, which cannot
+// make the queue grow by much; answers to the peer's frames go through
+// Offer.
+func (q *SendQueue) PushControl(msg *Outgoing) error {
+	if len(msg.Frames) == 0 {
+		return nil
+	}
+	msg.pinned = true
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return ErrConnectionClosed
+	}
+	q.append(msg)
+	return nil
+}
+
+// Offer queues msg only if it fits below the high-water mark and fails
+// with ErrQueueFull otherwise, without waiting or dropping anything. It is
+// for frames that may be left out, such as heartbeat acknowledgements,
+// which a peer could otherwise make pile up by not reading.
+func (q *SendQueue) Offer(msg *Outgoing) error {
+	return q.push(msg, OVERFLOW_ERROR)
+}
+
+func (q *SendQueue) push(msg *Outgoing, policy OverflowPolicy) error {
+	if len(msg.Frames) == 0 {
+		return nil
+	}
+	size := msg.Size()
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for !q.closed && q.queued > 0 && q.queued+size > q.highWaterMark {
+		if policy == OVERFLOW_ERROR {
+			return ErrQueueFull
+		}
+		if policy == OVERFLOW_DROP_OLDEST && q.dropOldest() {
+			continue
+		}
+		q.cond.Wait()
+	}
+
+	if q.closed {
+		return ErrConnectionClosed
+	}
+	q.append(msg)
+	return nil
+}
+
+func (q *SendQueue) append(msg *Outgoing) {
+	q.messages = append(q.messages, msg)
+	q.queued += msg.Size()
+	q.cond.Broadcast()
+}
+
+// dropOldest removes the oldest message none of whose frames have been
+// taken by the writer yet, leaving alone those that must not be dropped.
+func (q *SendQueue) dropOldest() bool {
+	for i, msg := range q.messages {
+		if msg.next > 0 || msg.pinned {
+			continue
+		}
+
+		q.queued -= msg.Size()
+		q.remove(i)
+		return true
+	}
+	return false
+}
+
+func (q *SendQueue) remove(i int) {
+	copy(q.messages[i:], q.messages[i+1:])
+	q.messages[len(q.messages)-1] = nil
+	q.messages = q.messages[:len(q.messages)-1]
+	if i < q.turn {
+		q.turn--
+	}
+}
+
+// Next blocks until a frame is ready to be written and returns it, taking
+// frames from the queued messages round-robin. It returns false once the
+// queue is closed.
+func (q *SendQueue) Next() ([]byte, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for !q.closed && len(q.messages) == 0 {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return nil, false
+	}
+
+	if q.turn >= len(q.messages) {
+		q.turn = 0
+	}
+	msg := q.messages[q.turn]
+	frame := msg.Frames[msg.next]
+	msg.Frames[msg.next] = nil
+	msg.next++
+
+	if msg.next == len(msg.Frames) {
+		q.remove(q.turn)
+	} else {
+		q.turn++
+	}
+	return frame, true
+}
+
+// Release gives back n bytes the writer has put on the wire.
+func (q *SendQueue) Release(n int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.queued -= n
+	q.cond.Broadcast()
+}
+
+func (q *SendQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.queued
+}
+
+// Flush waits until everything pushed so far has been written, the queue is
+// closed or ctx is done.
+func (q *SendQueue) Flush(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() {
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+		q.cond.Broadcast()
+	})
+	defer stop()
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for !q.closed && q.queued > 0 && ctx.Err() == nil {
+		q.cond.Wait()
+	}
+	return ctx.Err()
+}
+
+func (q *SendQueue) Close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.closed = true
+	q.messages = nil
+	q.cond.Broadcast()
+}
+
+// Run writes queued frames to w until the queue is closed or a write fails.
+func (q *SendQueue) Run(w io.Writer) error {
+	for {
+		frame, ok := q.Next()
+		if !ok {
+			return nil
+		}
+
+		if _, err := w.Write(frame); err != nil {
+			return err
+		}
+		q.Release(len(frame))
+	}
+}
+
+func NewSendQueue(highWaterMark int, policy OverflowPolicy) *SendQueue {
+	q := &SendQueue{
+		highWaterMark: highWaterMark,
+		policy:        policy,
+	}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
@@ -0,0 +1,170 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+// outgoing builds a message of n frames whose contents name the message
+// and the frame, such as "a0".
+func outgoing(name string, n int) *Outgoing {
+	msg := &Outgoing{}
+	for i := 0; i < n; i++ {
+		msg.Frames = append(msg.Frames, []byte{name[0], byte('0' + i)})
+	}
+	return msg
+}
+
+func drain(q *SendQueue, n int) []string {
+	var frames []string
+	for i := 0; i < n; i++ {
+		frame, ok := q.Next()
+		if !ok {
+			break
+		}
+		frames = append(frames, string(frame))
+		q.Release(len(frame))
+	}
+	return frames
+}
+
+func TestSendQueueRoundRobin(t *testing.T) {
+	q := NewSendQueue(DEFAULT_HIGH_WATER_MARK, OVERFLOW_BLOCK)
+	q.Push(outgoing("a", 3))
+	q.Push(outgoing("b", 1))
+	q.Push(outgoing("c", 2))
+
+	got := drain(q, 4)
+	// d arrives while a and c still have frames left and joins the
+	// rotation behind them
+	q.Push(outgoing("d", 2))
+	got = append(got, drain(q, 4)...)
+
+	want := []string{"a0", "b0", "c0", "a1", "c1", "d0", "a2", "d1"}
+	if len(got) != len(want) {
+		t.Fatalf("Got frames %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Got frames %v, want %v", got, want)
+		}
+	}
+	if q.Len() != 0 {
+		t.Fatalf("Queue still holds %v bytes after draining it", q.Len())
+	}
+}
+
+func TestSendQueueDropOldestKeepsPinned(t *testing.T) {
+	q := NewSendQueue(4, OVERFLOW_DROP_OLDEST)
+	if err := q.PushBlocking(outgoing("r", 1)); err != nil {
+		t.Fatal(err)
+	}
+	q.Push(outgoing("a", 1))
+	q.Push(outgoing("b", 1))
+	q.Push(outgoing("c", 1))
+
+	got := drain(q, 2)
+	if len(got) != 2 || got[0] != "r0" || got[1] != "c0" {
+		t.Fatalf("Got frames %v, want [r0 c0]", got)
+	}
+}
+
+func TestSendQueueControlSkipsHighWaterMark(t *testing.T) {
+	q := NewSendQueue(2, OVERFLOW_ERROR)
+	q.Push(outgoing("a", 1))
+	if err := q.Push(outgoing("b", 1)); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("Push on a full queue returned %v, want ErrQueueFull", err)
+	}
+	if err := q.PushControl(outgoing("h", 1)); err != nil {
+		t.Fatalf("PushControl on a full queue returned %v", err)
+	}
+
+	q.Close()
+	if err := q.PushControl(outgoing("h", 1)); !errors.Is(err, ErrConnectionClosed) {
+		t.Fatalf("PushControl on a closed queue returned %v, want ErrConnectionClosed", err)
+	}
+}
+
+func TestSendQueueOfferNeverGrowsPastHighWaterMark(t *testing.T) {
+	q := NewSendQueue(4, OVERFLOW_BLOCK)
+	for i := 0; i < 2; i++ {
+		if err := q.Offer(outgoing("a", 1)); err != nil {
+			t.Fatalf("Offer below the high-water mark returned %v", err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if err := q.Offer(outgoing("b", 1)); !errors.Is(err, ErrQueueFull) {
+			t.Fatalf("Offer on a full queue returned %v, want ErrQueueFull", err)
+		}
+	}
+	if q.Len() != 4 {
+		t.Fatalf("Queue holds %v bytes, want 4", q.Len())
+	}
+}
+
+// BenchmarkSendQueueMixed pushes small messages interleaved with ones that
+// span many frames, as events and stream chunks share a connection.
+func BenchmarkSendQueueMixed(b *testing.B) {
+	encoder := NewEncoder(FRAME_SIZE)
+	small := make([]byte, 64)
+	large := make([]byte, 64*1024)
+
+	q := NewSendQueue(DEFAULT_HIGH_WATER_MARK, OVERFLOW_BLOCK)
+	done := make(chan error)
+	go func() {
+		done <- q.Run(io.Discard)
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data := small
+		if i%16 == 0 {
+			data = large
+		}
+		seq, frames := encoder.Encode(FRAME_TYPE_MESSAGE, data)
+		if err := q.Push(&Outgoing{Seq: seq, Frames: frames}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	q.Flush(context.Background())
+	b.StopTimer()
+
+	q.Close()
+	if err := <-done; err != nil {
+		b.Fatal(err)
+	}
+}
+
+// BenchmarkSendQueueIdleWakeup measures how long an idle writer takes to
+// pick up a single message and put it on the wire.
+func BenchmarkSendQueueIdleWakeup(b *testing.B) {
+	encoder := NewEncoder(FRAME_SIZE)
+	data := make([]byte, 64)
+
+	q := NewSendQueue(DEFAULT_HIGH_WATER_MARK, OVERFLOW_BLOCK)
+	done := make(chan error)
+	go func() {
+		done <- q.Run(io.Discard)
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		seq, frames := encoder.Encode(FRAME_TYPE_MESSAGE, data)
+		if err := q.Push(&Outgoing{Seq: seq, Frames: frames}); err != nil {
+			b.Fatal(err)
+		}
+		if err := q.Flush(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	q.Close()
+	if err := <-done; err != nil {
+		b.Fatal(err)
+	}
+}
@@ -0,0 +1,201 @@
+package protocol
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	FRAME_TYPE_REQUEST  FrameType = 94
+	FRAME_TYPE_RESPONSE FrameType = 95
+)
+
+const (
+	STATUS_OK    byte = 0
+	STATUS_ERROR byte = 1
+)
+
+const (
+	DEFAULT_REQUEST_TIMEOUT = time.Second * 30
+)
+
+var (
+	ErrConnectionClosed = errors.New("Connection is already closed")
+	ErrAcksNotSupported = errors.New("Peer did not accept acknowledgements during the handshake")
+	ErrMalformedRequest = errors.New("Malformed request frame")
+)
+
+// RemoteError is returned by a request whose handler failed on the peer.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "Remote error: " + e.Message
+}
+
+// Response is the payload of a FRAME_TYPE_RESPONSE frame:
+//
+//	| request id uint32 | status byte | data or error message ... |
+type Response struct {
+	Id     uint32
+	Status byte
+	Data   []byte
+}
+
+func (r *Response) Err() error {
+	if r.Status == STATUS_OK {
+		return nil
+	}
+	return &RemoteError{Message: string(r.Data)}
+}
+
+// NewResponse is the reply to request id, carrying data or, if the handler
+// failed, err's message.
+func NewResponse(id uint32, data []byte, err error) *Response {
+	if err != nil {
+		return &Response{Id: id, Status: STATUS_ERROR, Data: []byte(err.Error())}
+	}
+	return &Response{Id: id, Status: STATUS_OK, Data: data}
+}
+
+func (r *Response) Bytes() []byte {
+	buff := make([]byte, 5, 5+len(r.Data))
+	binary.BigEndian.PutUint32(buff[0:4], r.Id)
+	buff[4] = r.Status
+	return append(buff, r.Data...)
+}
+
+func DecodeResponse(payload []byte) (*Response, error) {
+	if len(payload) < 5 {
+		return nil, ErrMalformedRequest
+	}
+
+	return &Response{
+		Id:     binary.BigEndian.Uint32(payload[0:4]),
+		Status: payload[4],
+		Data:   payload[5:],
+	}, nil
+}
+
+// EncodeRequest builds the payload of a FRAME_TYPE_REQUEST frame, which is a
+// message prefixed with the id the response will be correlated by:
+//
+//	| request id uint32 | message ... |
+func EncodeRequest(id uint32, event string, data []byte) ([]byte, error) {
+	msg, err := EncodeMessage(0, event, data)
+	if err != nil {
+		return nil, err
+	}
+
+	buff := make([]byte, 4, 4+len(msg))
+	binary.BigEndian.PutUint32(buff, id)
+	return append(buff, msg...), nil
+}
+
+func DecodeRequest(payload []byte) (uint32, *Message, error) {
+	if len(payload) < 4 {
+		return 0, nil, ErrMalformedRequest
+	}
+
+	msg, err := DecodeMessage(payload[4:])
+	if err != nil {
+		return 0, nil, err
+	}
+	return binary.BigEndian.Uint32(payload[0:4]), msg, nil
+}
+
+// Pending correlates outstanding requests with the responses that answer
+// them.
+type Pending struct {
+	next    uint32
+	waiting map[uint32]chan *Response
+	closed  bool
+	mutex   sync.Mutex
+}
+
+// Add reserves a request id and returns the channel its response will be
+// delivered on. The channel is closed without a value if the connection
+// goes away first.
+func (p *Pending) Add() (uint32, <-chan *Response, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return 0, nil, ErrConnectionClosed
+	}
+
+	p.next++
+	id := p.next
+	reply := make(chan *Response, 1)
+	p.waiting[id] = reply
+	return id, reply, nil
+}
+
+// Do sends a request on event with send and waits for the response or for
+// ctx to be done. A handler failing on the peer's side is reported as a
+// *RemoteError.
+func (p *Pending) Do(ctx context.Context, event string, data []byte, send func(payload []byte) error) ([]byte, error) {
+	id, reply, err := p.Add()
+	if err != nil {
+		return nil, err
+	}
+	defer p.Cancel(id)
+
+	payload, err := EncodeRequest(id, event, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := send(payload); err != nil {
+		return nil, err
+	}
+
+	select {
+	case res, ok := <-reply:
+		if !ok {
+			return nil, ErrConnectionClosed
+		}
+		if err := res.Err(); err != nil {
+			return nil, err
+		}
+		return res.Data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *Pending) Resolve(res *Response) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	reply, ok := p.waiting[res.Id]
+	if ok {
+		delete(p.waiting, res.Id)
+		reply <- res
+	}
+	return ok
+}
+
+func (p *Pending) Cancel(id uint32) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.waiting, id)
+}
+
+func (p *Pending) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.closed = true
+	for id, reply := range p.waiting {
+		close(reply)
+		delete(p.waiting, id)
+	}
+}
+
+func NewPending() *Pending {
+	return &Pending{waiting: map[uint32]chan *Response{}}
+}
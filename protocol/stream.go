@@ -0,0 +1,496 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+const (
+	FRAME_TYPE_STREAM FrameType = 97
+)
+
+const (
+	STREAM_OPEN   byte = 0
+	STREAM_DATA   byte = 1
+	STREAM_END    byte = 2
+	STREAM_ABORT  byte = 3
+	STREAM_CREDIT byte = 4
+	STREAM_CANCEL byte = 5
+)
+
+const (
+	STREAM_HEADER_SIZE int = 5
+	STREAM_CHUNK_SIZE  int = 32 * 1024
+	// STREAM_WINDOW is how much of a stream the receiver buffers, and so how
+	// far the sender may get ahead of the handler reading it.
+	STREAM_WINDOW int = 256 * 1024
+)
+
+var (
+	ErrMalformedStream = errors.New("Malformed stream frame")
+	ErrStreamClosed    = errors.New("Stream is already closed")
+	ErrStreamCanceled  = errors.New("Stream was canceled by the receiver")
+	ErrStreamWindow    = errors.New("Stream data exceeds the flow control window")
+)
+
+// StreamFrame is the payload of a FRAME_TYPE_STREAM frame:
+//
+//	| stream id uint32 | kind byte | data ... |
+//
+// A stream starts with a STREAM_OPEN frame whose data is the event name,
+// carries its content in STREAM_DATA frames and finishes with STREAM_END,
+// or STREAM_ABORT whose data is the reason. Every stream frame travels as
+// a single wire frame so chunks of one stream are never reordered.
+//
+// If both sides accepted FEATURE_STREAM_FLOW, the sender may only get
+// STREAM_WINDOW bytes of data ahead of the receiving handler. The receiver
+// hands out more as the handler reads with STREAM_CREDIT frames, whose data
+// is the number of bytes (uint32), and sends STREAM_CANCEL if the handler
+// returned before the end of the stream. Both carry the id of the stream
+// they refer to.
+type StreamFrame struct {
+	Id   uint32
+	Kind byte
+	Data []byte
+}
+
+func (f *StreamFrame) Bytes() []byte {
+	buff := make([]byte, STREAM_HEADER_SIZE, STREAM_HEADER_SIZE+len(f.Data))
+	binary.BigEndian.PutUint32(buff[0:4], f.Id)
+	buff[4] = f.Kind
+	return append(buff, f.Data...)
+}
+
+func DecodeStreamFrame(payload []byte) (*StreamFrame, error) {
+	if len(payload) < STREAM_HEADER_SIZE {
+		return nil, ErrMalformedStream
+	}
+
+	return &StreamFrame{
+		Id:   binary.BigEndian.Uint32(payload[0:4]),
+		Kind: payload[4],
+		Data: payload[STREAM_HEADER_SIZE:],
+	}, nil
+}
+
+// StreamWriter sends everything written to it as a stream, one chunk at a
+// time, so only a chunk is ever held in memory on top of what the send
+// queue buffers. With flow control, writes wait while the receiver has
+// STREAM_WINDOW bytes of the stream unread.
+type StreamWriter struct {
+	id        uint32
+	chunkSize int
+	send      func(payload []byte) error
+	streams   *Streams
+	// credit is nil without flow control.
+	credit *credit
+	closed bool
+	mutex  sync.Mutex
+}
+
+func (w *StreamWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return 0, ErrStreamClosed
+	}
+
+	written := 0
+	for written < len(p) {
+		size := len(p) - written
+		if size > w.chunkSize {
+			size = w.chunkSize
+		}
+		if w.credit != nil {
+			var err error
+			if size, err = w.credit.take(size); err != nil {
+				return written, err
+			}
+		}
+
+		chunk := &StreamFrame{Id: w.id, Kind: STREAM_DATA, Data: p[written : written+size]}
+		if err := w.send(chunk.Bytes()); err != nil {
+			return written, err
+		}
+		written += size
+	}
+	return written, nil
+}
+
+// Close ends the stream; the reader on the other side sees io.EOF.
+func (w *StreamWriter) Close() error {
+	return w.finish(&StreamFrame{Id: w.id, Kind: STREAM_END})
+}
+
+// CloseWithError aborts the stream; the reader on the other side sees a
+// *RemoteError carrying err's message.
+func (w *StreamWriter) CloseWithError(err error) error {
+	return w.finish(&StreamFrame{Id: w.id, Kind: STREAM_ABORT, Data: []byte(err.Error())})
+}
+
+func (w *StreamWriter) finish(frame *StreamFrame) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return ErrStreamClosed
+	}
+	w.closed = true
+	w.streams.forget(w)
+	return w.send(frame.Bytes())
+}
+
+// credit is how much of a stream its sender may still send before the
+// receiver has to make room.
+type credit struct {
+	available int
+	err       error
+	mutex     sync.Mutex
+	cond      *sync.Cond
+}
+
+// take waits until some credit is available and takes up to max of it.
+func (c *credit) take(max int) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for c.err == nil && c.available == 0 {
+		c.cond.Wait()
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	if max > c.available {
+		max = c.available
+	}
+	c.available -= max
+	return max, nil
+}
+
+func (c *credit) grant(n int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.available += n
+	c.cond.Broadcast()
+}
+
+// fail makes take fail with err from now on.
+func (c *credit) fail(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.cond.Broadcast()
+}
+
+func newCredit(available int) *credit {
+	c := &credit{available: available}
+	c.cond = sync.NewCond(&c.mutex)
+	return c
+}
+
+// StreamReader yields the content of an incoming stream as it arrives,
+// buffering up to STREAM_WINDOW bytes of it.
+type StreamReader struct {
+	id      uint32
+	streams *Streams
+	buff    []byte
+	// err is why the stream ended: io.EOF, a *RemoteError or
+	// ErrConnectionClosed.
+	err    error
+	closed bool
+	// unacked is how much has been read without handing out credit for it.
+	unacked int
+	mutex   sync.Mutex
+	cond    *sync.Cond
+}
+
+// Read blocks until some of the stream has arrived or the stream ended.
+func (r *StreamReader) Read(p []byte) (int, error) {
+	r.mutex.Lock()
+	for len(r.buff) == 0 && r.err == nil && !r.closed {
+		r.cond.Wait()
+	}
+	if r.closed {
+		r.mutex.Unlock()
+		return 0, ErrStreamClosed
+	}
+	if len(r.buff) == 0 {
+		r.mutex.Unlock()
+		return 0, r.err
+	}
+
+	n := copy(p, r.buff)
+	r.buff = r.buff[n:]
+	if len(r.buff) == 0 {
+		r.buff = nil
+	}
+	r.cond.Broadcast()
+
+	// hand out credit in batches rather than for every read
+	grant := 0
+	r.unacked += n
+	if r.err == nil && r.unacked >= STREAM_WINDOW/2 {
+		grant, r.unacked = r.unacked, 0
+	}
+	r.mutex.Unlock()
+
+	if grant > 0 {
+		r.streams.grant(r.id, grant)
+	}
+	return n, nil
+}
+
+// Close discards the rest of the stream. The sender is told to stop if
+// the stream has not ended yet.
+func (r *StreamReader) Close() error {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return nil
+	}
+	r.closed = true
+	r.buff = nil
+	ended := r.err != nil
+	r.cond.Broadcast()
+	r.mutex.Unlock()
+
+	r.streams.drop(r, !ended)
+	return nil
+}
+
+// feed buffers data. With flow control the sender must not go past the
+// window; without it, feed waits for the handler to make room.
+func (r *StreamReader) feed(data []byte, flow bool) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for !flow && !r.closed && r.err == nil && len(r.buff) >= STREAM_WINDOW {
+		r.cond.Wait()
+	}
+	if r.closed || r.err != nil {
+		return nil
+	}
+	if flow && len(r.buff)+len(data) > STREAM_WINDOW {
+		return ErrStreamWindow
+	}
+
+	r.buff = append(r.buff, data...)
+	r.cond.Broadcast()
+	return nil
+}
+
+// finish ends the stream with err once the buffered data has been read.
+func (r *StreamReader) finish(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.err == nil {
+		r.err = err
+	}
+	r.cond.Broadcast()
+}
+
+func newStreamReader(id uint32, streams *Streams) *StreamReader {
+	r := &StreamReader{id: id, streams: streams}
+	r.cond = sync.NewCond(&r.mutex)
+	return r
+}
+
+// Streams tracks the streams of a connection in both directions.
+type Streams struct {
+	// Flow turns on flow control, once the handshake accepted
+	// FEATURE_STREAM_FLOW. It must be set before any stream is opened.
+	Flow    bool
+	next    uint32
+	readers map[uint32]*StreamReader
+	writers map[uint32]*StreamWriter
+	control func(payload []byte) error
+	closed  bool
+	mutex   sync.Mutex
+}
+
+// Open announces a stream on event and returns a writer for it. send must
+// queue each payload as a single FRAME_TYPE_STREAM frame of at most
+// maxPayload bytes (0 meaning unlimited), waiting for room in the queue
+// rather than dropping it.
+func (s *Streams) Open(event string, maxPayload int, send func(payload []byte) error) (*StreamWriter, error) {
+	chunkSize := STREAM_CHUNK_SIZE
+	if maxPayload > 0 && maxPayload-STREAM_HEADER_SIZE < chunkSize {
+		chunkSize = maxPayload - STREAM_HEADER_SIZE
+	}
+	if chunkSize < 1 || len(event) > chunkSize {
+		return nil, errors.New("Event name does not fit in a single stream frame")
+	}
+
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil, ErrConnectionClosed
+	}
+	s.next++
+	w := &StreamWriter{id: s.next, chunkSize: chunkSize, send: send, streams: s}
+	if s.Flow {
+		w.credit = newCredit(STREAM_WINDOW)
+	}
+	s.writers[w.id] = w
+	s.mutex.Unlock()
+
+	open := &StreamFrame{Id: w.id, Kind: STREAM_OPEN, Data: []byte(event)}
+	if err := send(open.Bytes()); err != nil {
+		s.forget(w)
+		return nil, err
+	}
+	return w, nil
+}
+
+// Accept starts receiving the stream with the given id. The returned
+// reader must be closed once the handler is done with it.
+func (s *Streams) Accept(id uint32) *StreamReader {
+	r := newStreamReader(id, s)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		r.finish(ErrConnectionClosed)
+		return r
+	}
+	if old, ok := s.readers[id]; ok {
+		old.finish(ErrMalformedStream)
+	}
+	s.readers[id] = r
+	return r
+}
+
+// Refuse tells the sender of a stream nobody is going to read to stop.
+func (s *Streams) Refuse(id uint32) {
+	s.cancel(id)
+}
+
+// Feed delivers a stream frame other than STREAM_OPEN: data, end and abort
+// frames to the reader of their stream, credit and cancel frames to the
+// writer. Frames of streams that were never opened, or that were closed
+// since, are dropped. Without flow control Feed waits while the reader has
+// STREAM_WINDOW bytes unread; with it, a sender going past the window is an
+// error.
+func (s *Streams) Feed(frame *StreamFrame) error {
+	switch frame.Kind {
+	case STREAM_DATA, STREAM_END, STREAM_ABORT:
+		s.mutex.Lock()
+		r, ok := s.readers[frame.Id]
+		if ok && frame.Kind != STREAM_DATA {
+			delete(s.readers, frame.Id)
+		}
+		flow := s.Flow
+		s.mutex.Unlock()
+
+		if !ok {
+			return nil
+		}
+		switch frame.Kind {
+		case STREAM_DATA:
+			return r.feed(frame.Data, flow)
+		case STREAM_END:
+			r.finish(io.EOF)
+		default:
+			r.finish(&RemoteError{Message: string(frame.Data)})
+		}
+		return nil
+	case STREAM_CREDIT, STREAM_CANCEL:
+		if frame.Kind == STREAM_CREDIT && len(frame.Data) != 4 {
+			return ErrMalformedStream
+		}
+
+		s.mutex.Lock()
+		w, ok := s.writers[frame.Id]
+		if ok && frame.Kind == STREAM_CANCEL {
+			delete(s.writers, frame.Id)
+		}
+		s.mutex.Unlock()
+
+		if !ok || w.credit == nil {
+			return nil
+		}
+		if frame.Kind == STREAM_CREDIT {
+			w.credit.grant(int(binary.BigEndian.Uint32(frame.Data)))
+		} else {
+			w.credit.fail(ErrStreamCanceled)
+		}
+		return nil
+	default:
+		return ErrMalformedStream
+	}
+}
+
+// Close fails every open stream with ErrConnectionClosed.
+func (s *Streams) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	for id, r := range s.readers {
+		r.finish(ErrConnectionClosed)
+		delete(s.readers, id)
+	}
+	for id, w := range s.writers {
+		if w.credit != nil {
+			w.credit.fail(ErrConnectionClosed)
+		}
+		delete(s.writers, id)
+	}
+}
+
+// forget stops tracking a writer that finished.
+func (s *Streams) forget(w *StreamWriter) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.writers[w.id] == w {
+		delete(s.writers, w.id)
+	}
+}
+
+// drop stops tracking a reader whose handler is done with it, telling the
+// sender to stop if cancel is set.
+func (s *Streams) drop(r *StreamReader, cancel bool) {
+	s.mutex.Lock()
+	if s.readers[r.id] == r {
+		delete(s.readers, r.id)
+	}
+	s.mutex.Unlock()
+
+	if cancel {
+		s.cancel(r.id)
+	}
+}
+
+// grant lets the sender of a stream send n more bytes.
+func (s *Streams) grant(id uint32, n int) {
+	if !s.Flow {
+		return
+	}
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32(n))
+	s.control((&StreamFrame{Id: id, Kind: STREAM_CREDIT, Data: data}).Bytes())
+}
+
+func (s *Streams) cancel(id uint32) {
+	if !s.Flow {
+		return
+	}
+	s.control((&StreamFrame{Id: id, Kind: STREAM_CANCEL}).Bytes())
+}
+
+// NewStreams tracks the streams of a connection, sending the frames that
+// flow control takes with control, which must not block.
+func NewStreams(control func(payload []byte) error) *Streams {
+	return &Streams{
+		readers: map[uint32]*StreamReader{},
+		writers: map[uint32]*StreamWriter{},
+		control: control,
+	}
+}
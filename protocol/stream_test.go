@@ -0,0 +1,186 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// streamPair connects two sides of a connection with flow control: streams
+// opened on sender arrive on receiver, whose readers come out of accepted,
+// and credit and cancel frames find their way back. sent counts the stream
+// data that reached the receiver.
+type streamPair struct {
+	sender   *Streams
+	receiver *Streams
+	accepted chan *StreamReader
+	sent     int64
+	errs     chan error
+}
+
+func newStreamPair(t *testing.T) *streamPair {
+	t.Helper()
+
+	p := &streamPair{accepted: make(chan *StreamReader, 1), errs: make(chan error, 1)}
+	p.sender = NewStreams(func(payload []byte) error {
+		t.Error("Sender sent a control frame")
+		return nil
+	})
+	p.receiver = NewStreams(func(payload []byte) error {
+		frame, err := DecodeStreamFrame(payload)
+		if err != nil {
+			return err
+		}
+		return p.sender.Feed(frame)
+	})
+	p.sender.Flow = true
+	p.receiver.Flow = true
+	return p
+}
+
+// deliver is the send function of the streams opened on p.sender.
+func (p *streamPair) deliver(payload []byte) error {
+	frame, err := DecodeStreamFrame(payload)
+	if err != nil {
+		return err
+	}
+	if frame.Kind == STREAM_OPEN {
+		p.accepted <- p.receiver.Accept(frame.Id)
+		return nil
+	}
+	if err := p.receiver.Feed(frame); err != nil {
+		select {
+		case p.errs <- err:
+		default:
+		}
+		return err
+	}
+	if frame.Kind == STREAM_DATA {
+		atomic.AddInt64(&p.sent, int64(len(frame.Data)))
+	}
+	return nil
+}
+
+// open opens a stream and starts writing n bytes to it, returning the
+// reader on the other side and the writer's result.
+func (p *streamPair) open(t *testing.T, n int) (*StreamReader, chan error) {
+	t.Helper()
+
+	w, err := p.sender.Open("upload", 0, p.deliver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := <-p.accepted
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.Write(make([]byte, n))
+		done <- err
+	}()
+	return r, done
+}
+
+// waitSent waits until n bytes of stream data reached the receiver, and
+// fails if more than that arrive.
+func (p *streamPair) waitSent(t *testing.T, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&p.sent) < int64(n) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Sender sent %v bytes, want %v", atomic.LoadInt64(&p.sent), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if sent := atomic.LoadInt64(&p.sent); sent != int64(n) {
+		t.Fatalf("Sender sent %v bytes, want it to stop at %v", sent, n)
+	}
+}
+
+func TestStreamWriterWaitsForCredit(t *testing.T) {
+	p := newStreamPair(t)
+	r, done := p.open(t, 2*STREAM_WINDOW)
+
+	p.waitSent(t, STREAM_WINDOW)
+	select {
+	case err := <-done:
+		t.Fatalf("Write returned %v before the receiver made room", err)
+	default:
+	}
+
+	// reading half of the window hands out credit for it
+	if _, err := io.ReadFull(r, make([]byte, STREAM_WINDOW/2)); err != nil {
+		t.Fatal(err)
+	}
+	p.waitSent(t, STREAM_WINDOW+STREAM_WINDOW/2)
+
+	if _, err := io.ReadFull(r, make([]byte, STREAM_WINDOW+STREAM_WINDOW/2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Write returned %v", err)
+	}
+}
+
+func TestStreamsWindowExceeded(t *testing.T) {
+	s := NewStreams(func(payload []byte) error { return nil })
+	s.Flow = true
+	r := s.Accept(1)
+	defer r.Close()
+
+	chunk := bytes.Repeat([]byte("x"), STREAM_CHUNK_SIZE)
+	for sent := 0; sent < STREAM_WINDOW; sent += len(chunk) {
+		if err := s.Feed(&StreamFrame{Id: 1, Kind: STREAM_DATA, Data: chunk}); err != nil {
+			t.Fatalf("Feed within the window returned %v", err)
+		}
+	}
+	err := s.Feed(&StreamFrame{Id: 1, Kind: STREAM_DATA, Data: []byte("x")})
+	if !errors.Is(err, ErrStreamWindow) {
+		t.Fatalf("Feed past the window returned %v, want ErrStreamWindow", err)
+	}
+}
+
+func TestStreamWriterCanceled(t *testing.T) {
+	p := newStreamPair(t)
+	r, done := p.open(t, 2*STREAM_WINDOW)
+
+	if _, err := io.ReadFull(r, make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrStreamCanceled) {
+			t.Fatalf("Write returned %v, want ErrStreamCanceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write did not return after the reader was closed")
+	}
+}
+
+func TestStreamWriterConnectionClosed(t *testing.T) {
+	p := newStreamPair(t)
+	_, done := p.open(t, 2*STREAM_WINDOW)
+
+	p.waitSent(t, STREAM_WINDOW)
+	p.sender.Close()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrConnectionClosed) {
+			t.Fatalf("Write returned %v, want ErrConnectionClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write waiting for credit did not return after the connection closed")
+	}
+	select {
+	case err := <-p.errs:
+		t.Fatalf("Receiver rejected a frame: %v", err)
+	default:
+	}
+}
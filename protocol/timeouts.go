@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrIdleTimeout  = errors.New("Connection was idle for too long")
+	ErrReadTimeout  = errors.New("Timed out reading a frame")
+	ErrWriteTimeout = errors.New("Timed out writing a frame")
+)
+
+// IsData reports whether frames of type t carry application traffic, as
+// opposed to keeping the connection itself going.
+func (t FrameType) IsData() bool {
+	switch t {
+	case FRAME_TYPE_MESSAGE, FRAME_TYPE_REQUEST, FRAME_TYPE_RESPONSE, FRAME_TYPE_STREAM:
+		return true
+	default:
+		return false
+	}
+}
+
+// Activity records when a connection last carried application traffic in
+// either direction, for idle timeouts.
+type Activity struct {
+	last atomic.Int64
+}
+
+func (a *Activity) Touch() {
+	a.last.Store(time.Now().UnixNano())
+}
+
+func (a *Activity) Last() time.Time {
+	return time.Unix(0, a.last.Load())
+}
+
+func NewActivity() *Activity {
+	a := &Activity{}
+	a.Touch()
+	return a
+}
+
+// DeadlineWriter gives every write to Conn Timeout to complete, failing
+// with ErrWriteTimeout otherwise. A zero Timeout never gives up.
+type DeadlineWriter struct {
+	Conn    net.Conn
+	Timeout time.Duration
+}
+
+func (w *DeadlineWriter) Write(p []byte) (int, error) {
+	if w.Timeout <= 0 {
+		return w.Conn.Write(p)
+	}
+
+	w.Conn.SetWriteDeadline(time.Now().Add(w.Timeout))
+	n, err := w.Conn.Write(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = ErrWriteTimeout
+	}
+	return n, err
+}
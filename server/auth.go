@@ -0,0 +1,104 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"go-sockets/protocol"
+)
+
+// AUTH_TIMEOUT is how long a client has to answer the auth challenge.
+const AUTH_TIMEOUT = time.Second * 10
+
+// Identity is who a socket authenticated as.
+type Identity struct {
+	Subject string
+	Claims  map[string]any
+}
+
+// AuthRequest is what a client presented when authenticating. Challenge
+// is the random value the client had to sign for protocol.AUTH_HMAC.
+type AuthRequest struct {
+	protocol.Credentials
+	Challenge []byte
+}
+
+// VerifyHMAC reports whether the request carries the challenge signed with
+// key.
+func (r *AuthRequest) VerifyHMAC(key []byte) bool {
+	return r.Method == protocol.AUTH_HMAC && protocol.VerifyChallenge(key, r.Challenge, r.Secret)
+}
+
+// Authenticator decides whether a client may connect. The error's message
+// is sent to rejected clients as the reason. Returning a nil identity
+// accepts the client as its username. An authenticator that panics
+// rejects the client and is reported to OnError.
+type Authenticator func(socket *Socket, req *AuthRequest) (*Identity, error)
+
+// Identity returns who the socket authenticated as, or nil if the server
+// has no authenticator.
+func (s *Socket) Identity() *Identity {
+	return s.identity
+}
+
+// authenticate challenges the client and runs the server's authenticator
+// on its answer. It replies to the client either way.
+func (s *Socket) authenticate() error {
+	if !s.Supports(protocol.FEATURE_AUTH) {
+		s.reject("Authentication required")
+		return fmt.Errorf("Client does not support authentication")
+	}
+
+	challenge, err := protocol.NewChallenge()
+	if err != nil {
+		return err
+	}
+	raw(s, challenge, protocol.FRAME_TYPE_AUTH)
+
+	s.connection.SetReadDeadline(time.Now().Add(s.server.authTimeout))
+	frame, err := s.decoder.Decode()
+	s.connection.SetReadDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+	if frame.Type != protocol.FRAME_TYPE_AUTH {
+		s.reject("Authentication required")
+		return fmt.Errorf("Expected auth frame, got frame type %v", frame.Type)
+	}
+
+	creds, err := protocol.DecodeCredentials(frame.Payload)
+	if err != nil {
+		s.reject(err.Error())
+		return err
+	}
+
+	var identity *Identity
+	err = guard("authentication", func() error {
+		var err error
+		identity, err = s.server.authenticator(s, &AuthRequest{Credentials: *creds, Challenge: challenge})
+		return err
+	})
+	var panicErr *protocol.PanicError
+	if errors.As(err, &panicErr) {
+		s.reportError(err)
+		s.reject("Server could not check the credentials")
+		return err
+	}
+	if err != nil {
+		s.reject(err.Error())
+		return err
+	}
+	if identity == nil {
+		identity = &Identity{Subject: creds.Username}
+	}
+
+	s.identity = identity
+	return raw(s, []byte{}, protocol.FRAME_TYPE_AUTH)
+}
+
+// reject tells the client why it may not connect and waits briefly for
+// that to be written.
+func (s *Socket) reject(reason string) {
+	s.flushClose(protocol.NewCloseReason(protocol.CLOSE_AUTH_FAILED, reason))
+}
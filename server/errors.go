@@ -0,0 +1,56 @@
+package server
+
+import (
+	"errors"
+	"runtime/debug"
+
+	"go-sockets/protocol"
+)
+
+type ErrorHandler func(socket *Socket, err error)
+
+// OnError sets the handler for errors that concern a single socket: panics
+// in its handlers or the authenticator as a *protocol.PanicError, protocol violations as a
+// *protocol.ProtocolError (the socket is closed right after), errors
+// returned by middleware for plain events and replies to requests that
+// could not be sent. By default they are logged.
+func (s *Server) OnError(handler ErrorHandler) {
+	s.errorEvent = handler
+}
+
+func (s *Socket) reportError(err error) {
+	s.server.errorEvent(s, err)
+}
+
+// fail reports a protocol violation and closes the socket, telling the
+// peer why.
+func (s *Socket) fail(err error) *protocol.CloseReason {
+	s.reportError(err)
+	return s.close(protocol.NewCloseReason(protocol.CLOSE_PROTOCOL_ERROR, err.Error()))
+}
+
+// oversize reports a message over the size limit and closes the socket,
+// telling the peer why.
+func (s *Socket) oversize(err error) *protocol.CloseReason {
+	s.reportError(err)
+	return s.close(protocol.NewCloseReason(protocol.CLOSE_OVERSIZE, err.Error()))
+}
+
+// guard runs fn, turning a panic into a *protocol.PanicError.
+func guard(event string, fn func() error) (err error) {
+	defer func() {
+		if value := recover(); value != nil {
+			err = &protocol.PanicError{Event: event, Value: value, Stack: debug.Stack()}
+		}
+	}()
+	return fn()
+}
+
+func logError(socket *Socket, err error) {
+	var panicErr *protocol.PanicError
+	if errors.As(err, &panicErr) {
+		socket.server.logger.Printf("Socket %v: %v\n%s", socket.Id, err, panicErr.Stack)
+		return
+	}
+	socket.server.logger.Printf("Socket %v: %v\n", socket.Id, err)
+}
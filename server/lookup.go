@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go-sockets/protocol"
+)
+
+const (
+	DISCONNECT_FLUSH_TIMEOUT = time.Second
+)
+
+var ErrSocketNotFound = errors.New("No connected socket with that id")
+
+// Socket returns the connected socket with the given id.
+func (s *Server) Socket(id string) (*Socket, bool) {
+	return s.sockets.get(id)
+}
+
+// Sockets returns a snapshot of the connected sockets.
+func (s *Server) Sockets() []*Socket {
+	return s.sockets.snapshot()
+}
+
+func (s *Server) Count() int {
+	return s.sockets.len()
+}
+
+// Each calls fn for every connected socket until fn returns false. Sockets
+// connecting or disconnecting meanwhile may or may not be visited.
+func (s *Server) Each(fn func(socket *Socket) bool) {
+	for _, socket := range s.sockets.snapshot() {
+		if !fn(socket) {
+			return
+		}
+	}
+}
+
+// Emit sends data on event to the socket with the given id.
+func (s *Server) Emit(id, event string, data []byte) error {
+	socket, ok := s.sockets.get(id)
+	if !ok {
+		return ErrSocketNotFound
+	}
+	return socket.Emit(event, data)
+}
+
+// Disconnect tells the socket with the given id why it is being dropped and
+// closes its connection.
+func (s *Server) Disconnect(id, reason string) error {
+	socket, ok := s.sockets.get(id)
+	if !ok {
+		return ErrSocketNotFound
+	}
+	socket.close(protocol.NewCloseReason(protocol.CLOSE_KICKED, reason))
+	return nil
+}
+
+// close sends a close frame carrying reason, gives the writer a moment to
+// put it on the wire and then disconnects. It returns reason.
+func (s *Socket) close(reason *protocol.CloseReason) *protocol.CloseReason {
+	s.flushClose(reason)
+	s.disconnect(reason)
+	return reason
+}
+
+// flushClose sends a close frame carrying reason and waits briefly for it
+// to be written.
+func (s *Socket) flushClose(reason *protocol.CloseReason) {
+	if raw(s, reason.Bytes(), protocol.FRAME_TYPE_CLOSE) == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), DISCONNECT_FLUSH_TIMEOUT)
+		s.queue.Flush(ctx)
+		cancel()
+	}
+}
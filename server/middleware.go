@@ -0,0 +1,61 @@
+package server
+
+import "go-sockets/protocol"
+
+// Handler handles an inbound event or request. An error fails a request
+// with that error as the reply; for plain events it is only logged.
+type Handler func(socket *Socket, msg *protocol.Message) error
+
+// Middleware wraps the handling of inbound events and requests. It may
+// inspect or modify msg before calling next, time or log the call, or
+// short-circuit it by not calling next at all.
+type Middleware func(next Handler) Handler
+
+// Use adds middleware run for the events and requests of every socket,
+// before any middleware of the socket itself. Middleware run in the order
+// they were added.
+func (s *Server) Use(middleware ...Middleware) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.middleware = append(s.middleware, middleware...)
+}
+
+// Use adds middleware run for this socket's events and requests, after the
+// server's middleware.
+func (s *Socket) Use(middleware ...Middleware) {
+	s.middlewareMutex.Lock()
+	defer s.middlewareMutex.Unlock()
+	s.middleware = append(s.middleware, middleware...)
+}
+
+// chain wraps final in the server's and the socket's middleware.
+func (s *Socket) chain(final Handler) Handler {
+	s.server.mutex.Lock()
+	global := s.server.middleware
+	s.server.mutex.Unlock()
+
+	s.middlewareMutex.RLock()
+	own := s.middleware
+	s.middlewareMutex.RUnlock()
+
+	handler := final
+	for i := len(own) - 1; i >= 0; i-- {
+		handler = own[i](handler)
+	}
+	for i := len(global) - 1; i >= 0; i-- {
+		handler = global[i](handler)
+	}
+	return handler
+}
+
+func (s *Socket) handleMessage(msg *protocol.Message) {
+	err := guard(msg.Event, func() error {
+		return s.chain(func(socket *Socket, msg *protocol.Message) error {
+			socket.Envoke(msg)
+			return nil
+		})(s, msg)
+	})
+	if err != nil {
+		s.reportError(err)
+	}
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go-sockets/codec"
+	"go-sockets/compress"
+	"go-sockets/protocol"
+)
+
+// Option configures a Server. Options check their arguments, so New fails
+// with a descriptive error instead of the server misbehaving later.
+type Option func(*Server) error
+
+// WithTLS makes the server accept TLS connections only. Set ClientAuth to
+// tls.RequireAndVerifyClientCert (and ClientCAs) on config for mutual TLS.
+func WithTLS(config *tls.Config) Option {
+	return func(s *Server) error {
+		if config == nil {
+			return errors.New("TLS config must not be nil")
+		}
+		s.tlsConfig = config
+		return nil
+	}
+}
+
+// WithSendQueue bounds every socket's outbound queue to highWaterMark bytes
+// and sets what Send and Emit do when it is full.
+func WithSendQueue(highWaterMark int, policy protocol.OverflowPolicy) Option {
+	return func(s *Server) error {
+		if highWaterMark <= 0 {
+			return fmt.Errorf("Send queue high-water mark must be positive, got %v", highWaterMark)
+		}
+		if policy != protocol.OVERFLOW_BLOCK && policy != protocol.OVERFLOW_DROP_OLDEST && policy != protocol.OVERFLOW_ERROR {
+			return fmt.Errorf("Unknown overflow policy %v", policy)
+		}
+		s.highWaterMark = highWaterMark
+		s.overflowPolicy = policy
+		return nil
+	}
+}
+
+// WithAuthenticator makes every client authenticate before it is
+// connected; rejected clients are sent the reason and disconnected
+// without firing OnConnection.
+func WithAuthenticator(authenticator Authenticator) Option {
+	return func(s *Server) error {
+		if authenticator == nil {
+			return errors.New("Authenticator must not be nil")
+		}
+		s.authenticator = authenticator
+		return nil
+	}
+}
+
+// WithAuthTimeout sets how long a client has to answer the auth challenge.
+// The default is AUTH_TIMEOUT.
+func WithAuthTimeout(timeout time.Duration) Option {
+	return func(s *Server) error {
+		if timeout <= 0 {
+			return fmt.Errorf("Auth timeout must be positive, got %v", timeout)
+		}
+		s.authTimeout = timeout
+		return nil
+	}
+}
+
+// WithDispatch sets in which order the event and request handlers of each
+// socket run. The default, protocol.DISPATCH_CONCURRENT, runs them all at
+// once; the ordered modes run them one at a time in arrival order, per
+// socket or per event of a socket. Stream handlers always run
+// concurrently. In the ordered modes a large message is handled before the
+// ones sent after it even if their chunks overtook it on the wire.
+func WithDispatch(mode protocol.DispatchMode) Option {
+	return func(s *Server) error {
+		if mode != protocol.DISPATCH_CONCURRENT && mode != protocol.DISPATCH_ORDERED && mode != protocol.DISPATCH_ORDERED_PER_EVENT {
+			return fmt.Errorf("Unknown dispatch mode %v", mode)
+		}
+		s.dispatchMode = mode
+		return nil
+	}
+}
+
+// WithHeartbeat sets how often sockets are sent a heartbeat. A client
+// asking for a shorter interval during the handshake gets its way, one
+// asking for a longer one does not, so every client is checked on at least
+// this often. The default is HEARTBEAT_INTERVAL seconds and the minimum
+// protocol.MIN_HEARTBEAT_INTERVAL.
+func WithHeartbeat(interval time.Duration) Option {
+	return func(s *Server) error {
+		if interval < protocol.MIN_HEARTBEAT_INTERVAL {
+			return fmt.Errorf("Heartbeat interval must be at least %v, got %v", protocol.MIN_HEARTBEAT_INTERVAL, interval)
+		}
+		s.heartbeatInterval = interval
+		return nil
+	}
+}
+
+// WithHeartbeatTolerance sets how many heartbeat intervals a client may
+// stay silent before it is disconnected with protocol.CLOSE_TIMEOUT. The
+// default is protocol.DEFAULT_MISSED_HEARTBEATS.
+func WithHeartbeatTolerance(missed int) Option {
+	return func(s *Server) error {
+		if missed < 1 {
+			return fmt.Errorf("Heartbeat tolerance must be at least 1, got %v", missed)
+		}
+		s.maxMissedHeartbeats = missed
+		return nil
+	}
+}
+
+// WithFrameSize sets the largest frame, header included, the server offers
+// to send and receive; messages are split into chunks of that size. The
+// smaller of the two sides' frame sizes is used. The default is
+// protocol.FRAME_SIZE and the minimum protocol.MIN_FRAME_SIZE.
+func WithFrameSize(size int) Option {
+	return func(s *Server) error {
+		if size < protocol.MIN_FRAME_SIZE {
+			return fmt.Errorf("Frame size must be at least %v bytes, got %v", protocol.MIN_FRAME_SIZE, size)
+		}
+		s.frameSize = size
+		return nil
+	}
+}
+
+// WithMaxMessageSize sets the largest message, after reassembling its
+// chunks, a socket accepts. A peer sending a bigger one is disconnected,
+// as is one that keeps more than protocol.MAX_BUFFERED_MESSAGES times as
+// much half-sent at once. The default is protocol.DEFAULT_MAX_MESSAGE_SIZE;
+// 0 accepts messages of any size.
+func WithMaxMessageSize(size int) Option {
+	return func(s *Server) error {
+		if size < 0 {
+			return fmt.Errorf("Maximum message size must not be negative, got %v", size)
+		}
+		s.maxMessageSize = size
+		return nil
+	}
+}
+
+// WithEventSizeLimit lowers the maximum message size for messages and
+// requests on event, which may be a pattern such as "uploads.*". The limit
+// is checked while the message is reassembled; a client sending a bigger
+// one is disconnected. If several limits match an event, the smallest
+// applies. Streams are not limited.
+func WithEventSizeLimit(event string, size int) Option {
+	return func(s *Server) error {
+		if event == "" {
+			return errors.New("Event must not be empty")
+		}
+		if size <= 0 {
+			return fmt.Errorf("Size limit for event %v must be positive, got %v", event, size)
+		}
+		s.eventSizeLimits[event] = size
+		return nil
+	}
+}
+
+// WithIdleTimeout disconnects sockets with protocol.CLOSE_IDLE_TIMEOUT once
+// no messages, requests, responses or stream data have gone either way for
+// longer than timeout. Heartbeats do not count as traffic. The default of 0
+// never does.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(s *Server) error {
+		if timeout < 0 {
+			return fmt.Errorf("Idle timeout must not be negative, got %v", timeout)
+		}
+		s.idleTimeout = timeout
+		return nil
+	}
+}
+
+// WithReadTimeout disconnects sockets with protocol.CLOSE_READ_TIMEOUT if
+// the rest of a frame takes longer than timeout to arrive once its first
+// byte has. The default of 0 waits forever.
+func WithReadTimeout(timeout time.Duration) Option {
+	return func(s *Server) error {
+		if timeout < 0 {
+			return fmt.Errorf("Read timeout must not be negative, got %v", timeout)
+		}
+		s.readTimeout = timeout
+		return nil
+	}
+}
+
+// WithWriteTimeout disconnects sockets with protocol.CLOSE_WRITE_TIMEOUT if
+// writing a frame to the client takes longer than timeout, which happens
+// once the client stops reading and the connection's buffers fill up. The
+// default of 0 waits forever.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(s *Server) error {
+		if timeout < 0 {
+			return fmt.Errorf("Write timeout must not be negative, got %v", timeout)
+		}
+		s.writeTimeout = timeout
+		return nil
+	}
+}
+
+// WithRequestTimeout sets how long Request waits for a reply when its
+// context has no deadline. The default is
+// protocol.DEFAULT_REQUEST_TIMEOUT.
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(s *Server) error {
+		if timeout <= 0 {
+			return fmt.Errorf("Request timeout must be positive, got %v", timeout)
+		}
+		s.requestTimeout = timeout
+		return nil
+	}
+}
+
+// WithCompression compresses message, request and response payloads of
+// at least minSize bytes for clients that support one of compressors,
+// which default to compress.Defaults(). The server picks the first of the
+// client's preferred compressors it also has. Payloads that do not shrink
+// are sent as they are.
+func WithCompression(minSize int, compressors ...compress.Compressor) Option {
+	return func(s *Server) error {
+		if minSize < 0 {
+			return fmt.Errorf("Minimum compression size must not be negative, got %v", minSize)
+		}
+		if len(compressors) == 0 {
+			compressors = compress.Defaults()
+		}
+		seen := map[byte]bool{}
+		for _, c := range compressors {
+			if c == nil {
+				return errors.New("Compressor must not be nil")
+			}
+			if c.Id() == 0 || seen[c.Id()] {
+				return fmt.Errorf("Compressor %v has a reserved or duplicate id %v", c.Name(), c.Id())
+			}
+			seen[c.Id()] = true
+		}
+		s.compressors = compressors
+		s.minCompressSize = minSize
+		return nil
+	}
+}
+
+// WithCodec registers c like RegisterCodec.
+func WithCodec(c codec.Codec, makeDefault bool) Option {
+	return func(s *Server) error {
+		return s.RegisterCodec(c, makeDefault)
+	}
+}
+
+// WithLogger sends the server's log output to logger instead of the
+// standard logger.
+func WithLogger(logger *log.Logger) Option {
+	return func(s *Server) error {
+		if logger == nil {
+			return errors.New("Logger must not be nil")
+		}
+		s.logger = logger
+		return nil
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"go-sockets/client"
+)
+
+// listening starts s and returns the address it listens on.
+func listening(t *testing.T, s *Server) string {
+	t.Helper()
+
+	go s.Listen()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mutex.Lock()
+		l := s.listener
+		s.mutex.Unlock()
+		if l != nil {
+			return l.Addr().String()
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("Server did not start listening")
+	return ""
+}
+
+// TestConcurrentClients connects and disconnects clients while the server
+// broadcasts to them and handlers come and go on both sides. Run it with
+// -race.
+func TestConcurrentClients(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Connects real clients")
+	}
+
+	logger := log.New(io.Discard, "", 0)
+	s, err := New("127.0.0.1:0", WithLogger(logger), WithHeartbeat(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.OnConnection(func(socket *Socket) {
+		socket.Join("all")
+		socket.On("ping", func(data string) {
+			socket.Broadcast("news", data)
+		})
+		socket.OnRequest("echo", func(data string) ([]byte, error) {
+			return []byte(data), nil
+		})
+	})
+	address := listening(t, s)
+
+	stop := make(chan struct{})
+	var server sync.WaitGroup
+	server.Add(1)
+	go func() {
+		defer server.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+			}
+
+			s.To("all").Send("news", "room")
+			s.Each(func(socket *Socket) bool {
+				subscription := socket.On("extra", func(data string) {})
+				socket.Send("news", "direct")
+				subscription.Off()
+				return true
+			})
+		}
+	}()
+
+	var clients sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			for i := 0; i < 10; i++ {
+				c, err := client.New(address, client.WithLogger(logger))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				c.On("news", func(data string) {})
+				if err := c.Start(); err != nil {
+					t.Error(err)
+					return
+				}
+
+				subscription := c.On("news", func(data string) {})
+				c.Send("ping", "hello")
+				reply, err := c.Request(context.Background(), "echo", []byte("hi"))
+				if err != nil || string(reply) != "hi" {
+					t.Errorf("Request returned %q, %v", reply, err)
+				}
+				c.Off("news", subscription)
+				c.Disconnect()
+			}
+		}()
+	}
+	clients.Wait()
+	close(stop)
+	server.Wait()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Count() > 0 || len(s.To("all").Sockets()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v sockets still connected and %v in the room after every client left", s.Count(), len(s.To("all").Sockets()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
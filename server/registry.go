@@ -0,0 +1,57 @@
+package server
+
+import "sync"
+
+// registry is the set of connected sockets, safe for concurrent use.
+// Iteration always happens over a snapshot so callers never hold the lock
+// while talking to a socket.
+type registry struct {
+	sockets map[string]*Socket
+	mutex   sync.RWMutex
+}
+
+func (r *registry) add(socket *Socket) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.sockets[socket.Id] = socket
+}
+
+func (r *registry) remove(socket *Socket) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.sockets[socket.Id]; !ok {
+		return false
+	}
+	delete(r.sockets, socket.Id)
+	return true
+}
+
+func (r *registry) get(id string) (*Socket, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	socket, ok := r.sockets[id]
+	return socket, ok
+}
+
+func (r *registry) len() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return len(r.sockets)
+}
+
+func (r *registry) snapshot() []*Socket {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	sockets := make([]*Socket, 0, len(r.sockets))
+	for _, socket := range r.sockets {
+		sockets = append(sockets, socket)
+	}
+	return sockets
+}
+
+func newRegistry() *registry {
+	return &registry{sockets: map[string]*Socket{}}
+}
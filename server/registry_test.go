@@ -0,0 +1,60 @@
+package server
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := newRegistry()
+	a, b := &Socket{Id: "a"}, &Socket{Id: "b"}
+	r.add(a)
+	r.add(b)
+
+	if socket, ok := r.get("a"); !ok || socket != a {
+		t.Fatalf("get(a) returned %v, %v", socket, ok)
+	}
+	if !r.remove(a) {
+		t.Fatal("Removing a registered socket returned false")
+	}
+	if r.remove(a) {
+		t.Fatal("Removing a socket twice returned true")
+	}
+	if _, ok := r.get("a"); ok {
+		t.Fatal("Removed socket is still registered")
+	}
+	if sockets := r.snapshot(); r.len() != 1 || len(sockets) != 1 || sockets[0] != b {
+		t.Fatalf("Registry holds %v sockets, snapshot %v, want only b", r.len(), sockets)
+	}
+}
+
+func TestRegistryConcurrent(t *testing.T) {
+	r := newRegistry()
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				socket := &Socket{Id: strconv.Itoa(worker) + "-" + strconv.Itoa(i)}
+				r.add(socket)
+				if _, ok := r.get(socket.Id); !ok {
+					t.Errorf("Socket %v is missing right after adding it", socket.Id)
+				}
+				for _, other := range r.snapshot() {
+					_ = other.Id
+				}
+				if i%2 == 0 && !r.remove(socket) {
+					t.Errorf("Socket %v could not be removed", socket.Id)
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	if r.len() != 8*250 {
+		t.Fatalf("Registry holds %v sockets, want %v", r.len(), 8*250)
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+// Room addresses every socket that joined a named group.
+type Room struct {
+	server *Server
+	name   string
+	except string
+}
+
+func (r *Room) Sockets() []*Socket {
+	r.server.roomsMutex.RLock()
+	defer r.server.roomsMutex.RUnlock()
+
+	sockets := make([]*Socket, 0, len(r.server.rooms[r.name]))
+	for id, socket := range r.server.rooms[r.name] {
+		if id == r.except {
+			continue
+		}
+		sockets = append(sockets, socket)
+	}
+	return sockets
+}
+
+func (r *Room) Send(event, data string) {
+	for _, socket := range r.Sockets() {
+		socket.Send(event, data)
+	}
+}
+
+func (r *Room) Emit(event string, data []byte) {
+	for _, socket := range r.Sockets() {
+		socket.Emit(event, data)
+	}
+}
+
+func (s *Server) To(room string) *Room {
+	return &Room{server: s, name: room}
+}
+
+// join adds socket to room unless it has disconnected. Checking under
+// roomsMutex keeps a Join racing with disconnect from outliving leaveAll.
+func (s *Server) join(socket *Socket, room string) {
+	s.roomsMutex.Lock()
+	defer s.roomsMutex.Unlock()
+
+	if !socket.connected.Load() {
+		return
+	}
+	if _, ok := s.rooms[room]; !ok {
+		s.rooms[room] = map[string]*Socket{}
+	}
+	s.rooms[room][socket.Id] = socket
+	socket.rooms[room] = true
+}
+
+func (s *Server) leave(socket *Socket, room string) {
+	s.roomsMutex.Lock()
+	defer s.roomsMutex.Unlock()
+
+	s.removeFromRoom(socket, room)
+}
+
+func (s *Server) leaveAll(socket *Socket) {
+	s.roomsMutex.Lock()
+	defer s.roomsMutex.Unlock()
+
+	for room := range socket.rooms {
+		s.removeFromRoom(socket, room)
+	}
+}
+
+func (s *Server) removeFromRoom(socket *Socket, room string) {
+	delete(socket.rooms, room)
+	if members, ok := s.rooms[room]; ok {
+		delete(members, socket.Id)
+		if len(members) == 0 {
+			delete(s.rooms, room)
+		}
+	}
+}
+
+// Join adds the socket to room. It does nothing once the socket has
+// disconnected.
+func (s *Socket) Join(room string) {
+	s.server.join(s, room)
+}
+
+func (s *Socket) Leave(room string) {
+	s.server.leave(s, room)
+}
+
+func (s *Socket) Rooms() []string {
+	s.server.roomsMutex.RLock()
+	defer s.server.roomsMutex.RUnlock()
+
+	rooms := make([]string, 0, len(s.rooms))
+	for room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// BroadcastTo sends to every member of room except this socket.
+func (s *Socket) BroadcastTo(room, event, data string) {
+	r := &Room{server: s.server, name: room, except: s.Id}
+	r.Send(event, data)
+}
@@ -1,25 +1,22 @@
 package server
 
 import (
-	"bufio"
-	"encoding/binary"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/google/uuid"
-)
-
-type FrameType byte
+	"go-sockets/codec"
+	"go-sockets/compress"
+	"go-sockets/protocol"
 
-const (
-	FRAME_SIZE               int       = 4096
-	FRAME_TYPE_MESSAGE       FrameType = 90
-	FRAME_TYPE_HEARTBEAT     FrameType = 91
-	FRAME_TYPE_HEARTBEAT_ACK FrameType = 92
+	"github.com/google/uuid"
 )
 
 const (
@@ -27,98 +24,237 @@ const (
 )
 
 type ConnectionHandler func(socket *Socket)
-type MessageHandler func(data string)
-
+type DisconnectionHandler func(socket *Socket, reason *protocol.CloseReason)
+type MessageHandler = protocol.MessageHandler
+type RequestHandler = protocol.RequestHandler
+type AnyHandler = protocol.AnyHandler
+type Subscription = protocol.Subscription
+
+// Socket is a connected client. Its handlers for the client's events,
+// requests and streams are registered through the embedded
+// protocol.Listeners.
 type Socket struct {
-	Id               string
-	connection       net.Conn
-	events           map[string]MessageHandler
-	server           *Server
-	connected        bool
-	lastHeartbeatAck int64
+	protocol.Listeners
+	Id              string
+	connection      net.Conn
+	transfers       *protocol.Streams
+	pending         *protocol.Pending
+	server          *Server
+	rooms           map[string]bool
+	middleware      []Middleware
+	middlewareMutex sync.RWMutex
+	connected       atomic.Bool
+	keepalive       *protocol.Keepalive
+	activity        *protocol.Activity
+	stalled         atomic.Bool
+	done            chan struct{}
+	reason          atomic.Value
+	encoder         *protocol.Encoder
+	decoder         *protocol.Decoder
+	handshake       *protocol.Handshake
+	identity        *Identity
+	queue           *protocol.SendQueue
+	dispatcher      *protocol.Dispatcher
+	compression     *protocol.Compression
 }
 
 type Server struct {
-	address         string
-	listener        net.Listener
-	sockets         map[string]*Socket
-	connectEvent    ConnectionHandler
-	disconnectEvent ConnectionHandler
+	address             string
+	listener            net.Listener
+	tlsConfig           *tls.Config
+	highWaterMark       int
+	overflowPolicy      protocol.OverflowPolicy
+	dispatchMode        protocol.DispatchMode
+	heartbeatInterval   time.Duration
+	maxMissedHeartbeats int
+	frameSize           int
+	maxMessageSize      int
+	eventSizeLimits     map[string]int
+	compressors         []compress.Compressor
+	minCompressSize     int
+	idleTimeout         time.Duration
+	readTimeout         time.Duration
+	writeTimeout        time.Duration
+	requestTimeout      time.Duration
+	authTimeout         time.Duration
+	logger              *log.Logger
+	codecs              *codec.Registry
+	authenticator       Authenticator
+	middleware          []Middleware
+	sockets             *registry
+	mutex               sync.Mutex
+	inShutdown          bool
+	handlers            sync.WaitGroup
+	rooms               map[string]map[string]*Socket
+	roomsMutex          sync.RWMutex
+	connectEvent        ConnectionHandler
+	disconnectEvent     DisconnectionHandler
+	errorEvent          ErrorHandler
 }
 
-func (s *Server) addSocket(conn net.Conn) *Socket {
-	uid := uuid.New().String()
-	sock := &Socket{Id: uid, connection: conn, events: map[string]MessageHandler{}, server: s, connected: true}
-	s.sockets[uid] = sock
-	return sock
+func (s *Server) newSocket(conn net.Conn) *Socket {
+	socket := &Socket{
+		Id:         uuid.New().String(),
+		connection: conn,
+		pending:    protocol.NewPending(),
+		server:     s,
+		rooms:      map[string]bool{},
+		encoder:    protocol.NewEncoder(s.frameSize),
+		decoder:    protocol.NewDecoder(conn),
+		queue:      protocol.NewSendQueue(s.highWaterMark, s.overflowPolicy),
+		done:       make(chan struct{}),
+		dispatcher: protocol.NewDispatcher(s.dispatchMode),
+		activity:   protocol.NewActivity(),
+	}
+	socket.transfers = protocol.NewStreams(func(payload []byte) error {
+		return raw(socket, payload, protocol.FRAME_TYPE_STREAM)
+	})
+	socket.encoder.Activity = socket.activity
+	socket.decoder.Activity = socket.activity
+	socket.decoder.Ordered = s.dispatchMode != protocol.DISPATCH_CONCURRENT
+	socket.decoder.MaxFrameSize = s.frameSize
+	socket.decoder.MaxMessageSize = s.maxMessageSize
+	socket.decoder.MaxBuffered = protocol.MAX_BUFFERED_MESSAGES * s.maxMessageSize
+	socket.decoder.EventSizeLimits = s.eventSizeLimits
+	socket.connected.Store(true)
+	return socket
+}
+
+func (s *Server) addSocket(socket *Socket) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.inShutdown {
+		return false
+	}
+	s.sockets.add(socket)
+	return true
 }
 
 func (s *Server) removeSocket(socket *Socket) {
-	if _, ok := s.sockets[socket.Id]; ok {
-		socket.connected = false
-		delete(s.sockets, socket.Id)
+	if s.sockets.remove(socket) {
+		socket.connected.Store(false)
 	}
 }
 
+// Listen accepts connections until the server is shut down, after which it
+// returns ErrServerClosed.
 func (s *Server) Listen() error {
-	l, err := net.Listen("tcp", s.address)
+	var l net.Listener
+	var err error
+	if s.tlsConfig != nil {
+		l, err = tls.Listen("tcp", s.address, s.tlsConfig)
+	} else {
+		l, err = net.Listen("tcp", s.address)
+	}
 	if err != nil {
 		return err
 	}
 	defer l.Close()
 
+	s.mutex.Lock()
+	if s.inShutdown {
+		s.mutex.Unlock()
+		return ErrServerClosed
+	}
 	s.listener = l
-	log.Println("Server listening on " + s.listener.Addr().String())
+	s.mutex.Unlock()
+	s.logger.Println("Server listening on " + l.Addr().String())
 
+	var backoff time.Duration
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := l.Accept()
 		if err != nil {
-			log.Printf("Couldn't accept connection: %v\n", err)
-		} else {
-			go s.handleConnection(conn)
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+
+			if backoff == 0 {
+				backoff = time.Millisecond * 5
+			} else if backoff *= 2; backoff > time.Second {
+				backoff = time.Second
+			}
+			s.logger.Printf("Couldn't accept connection: %v; retrying in %v\n", err, backoff)
+			time.Sleep(backoff)
+			continue
 		}
+
+		backoff = 0
+		go s.handleConnection(conn)
 	}
-	return nil
 }
 
 func (s *Server) OnConnection(handler ConnectionHandler) {
 	s.connectEvent = handler
 }
 
-func (s *Server) OnDisconnection(handler ConnectionHandler) {
+// OnDisconnection sets the handler that runs once a socket is gone, with
+// the reason it went away.
+func (s *Server) OnDisconnection(handler DisconnectionHandler) {
 	s.disconnectEvent = handler
 }
 
+// RegisterCodec makes c available for decoding typed events and, if
+// makeDefault is set, uses it to encode them.
+func (s *Server) RegisterCodec(c codec.Codec, makeDefault bool) error {
+	if err := s.codecs.Register(c); err != nil {
+		return err
+	}
+	if makeDefault {
+		return s.codecs.SetDefault(c.Id())
+	}
+	return nil
+}
+
 func (s *Server) Connection() net.Listener {
 	return s.listener
 }
 
-func (s *Socket) On(event string, callback MessageHandler) {
-	s.events[event] = callback
-}
+// Request sends data on event and waits for the peer's reply. If ctx has no
+// deadline, the server's request timeout applies. A handler failing on
+// the peer's side is reported as a *protocol.RemoteError.
+func (s *Socket) Request(ctx context.Context, event string, data []byte) ([]byte, error) {
+	if !s.Supports(protocol.FEATURE_ACKS) {
+		return nil, protocol.ErrAcksNotSupported
+	}
 
-func (s *Socket) Off(event string) {
-	if _, ok := s.events[event]; ok {
-		delete(s.events, event)
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.server.requestTimeout)
+		defer cancel()
 	}
+
+	return s.pending.Do(ctx, event, data, func(payload []byte) error {
+		return compressed(s, payload, protocol.FRAME_TYPE_REQUEST)
+	})
 }
 
-// Under development. Does not guarantee 100% synchronization
-func (s *Socket) SendSync(event, data string) {
-	send(s, event, data)
+// SendSync is the same as Send.
+//
+// Deprecated: Send no longer hands every message to a goroutine of its
+// own, so SendSync has nothing left to do differently. Use Send.
+func (s *Socket) SendSync(event, data string) error {
+	return send(s, event, data)
 }
 
-func (s *Socket) Send(event, data string) {
-	go send(s, event, data)
+// Send queues data for writing. When the send queue is past its high-water
+// mark it blocks, drops older messages or fails with protocol.ErrQueueFull,
+// depending on the socket's overflow policy.
+func (s *Socket) Send(event, data string) error {
+	return send(s, event, data)
 }
 
-func (s *Socket) Emit(event string, data []byte) {
-	go emit(s, event, data)
+// Emit is Send for binary data.
+func (s *Socket) Emit(event string, data []byte) error {
+	return emit(s, codec.CODEC_RAW, event, data)
 }
 
-// Under development. Does not guarantee 100% synchronization
-func (s *Socket) EmitSync(event string, data []byte) {
-	emit(s, event, data)
+// EmitSync is the same as Emit.
+//
+// Deprecated: Emit no longer hands every message to a goroutine of its
+// own, so EmitSync has nothing left to do differently. Use Emit.
+func (s *Socket) EmitSync(event string, data []byte) error {
+	return emit(s, codec.CODEC_RAW, event, data)
 }
 
 // func (s *Socket) BroadcastSync(event, data string) {
@@ -132,229 +268,452 @@ func (s *Socket) EmitSync(event string, data []byte) {
 // }
 
 func (s *Socket) Broadcast(event, data string) {
-	for id, socket := range s.server.sockets {
-		if id == s.Id {
+	for _, socket := range s.server.sockets.snapshot() {
+		if socket.Id == s.Id {
 			continue
 		}
-		go socket.Send(event, data)
+		socket.Send(event, data)
 	}
 }
 
 func (s *Socket) Connected() bool {
-	return s.connected
+	return s.connected.Load()
 }
 
 func (s *Socket) Connection() net.Conn {
 	return s.connection
 }
 
+// TLS returns the state of the TLS connection, or nil for plain TCP sockets.
+func (s *Socket) TLS() *tls.ConnectionState {
+	if conn, ok := s.connection.(*tls.Conn); ok {
+		state := conn.ConnectionState()
+		return &state
+	}
+	return nil
+}
+
+// PeerCertificate returns the client certificate verified during a mutual
+// TLS handshake, or nil if the client did not present a verified one.
+func (s *Socket) PeerCertificate() *x509.Certificate {
+	state := s.TLS()
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// Latency is the round trip time of the last heartbeat the client
+// answered.
+func (s *Socket) Latency() time.Duration {
+	if s.keepalive == nil {
+		return 0
+	}
+	return s.keepalive.Latency()
+}
+
+// DisconnectReason tells why a disconnected socket went away. It is nil
+// while the socket is connected.
+func (s *Socket) DisconnectReason() *protocol.CloseReason {
+	reason, _ := s.reason.Load().(*protocol.CloseReason)
+	return reason
+}
+
+// Supports reports whether feature was accepted during the handshake.
+func (s *Socket) Supports(feature uint32) bool {
+	return s.handshake != nil && s.handshake.Has(feature)
+}
+
+// Disconnect tells the client the server is hanging up and closes the
+// connection.
 func (s *Socket) Disconnect() {
-	s.disconnect()
+	s.close(protocol.NewCloseReason(protocol.CLOSE_NORMAL, ""))
 }
 
-func (s *Socket) disconnect() {
-	if !s.connected {
+// disconnect closes the connection, recording reason as the cause if the
+// socket is still connected.
+func (s *Socket) disconnect(reason *protocol.CloseReason) {
+	if !s.connected.CompareAndSwap(true, false) {
 		s.connection.Close()
 		return
 	}
-	s.connected = false
+	// connected is false by now, so no Join can add the socket back to
+	// a room once leaveAll has taken roomsMutex
+	s.server.leaveAll(s)
+	s.reason.Store(reason)
+	close(s.done)
+	s.queue.Close()
 	s.connection.Close()
-	s.server.disconnectEvent(s)
-}
-
-func (s *Socket) envokeEvent(name, data string) {
-	if handler, ok := s.events[name]; ok {
-		handler(data)
+	s.pending.Close()
+	s.transfers.Close()
+	s.server.removeSocket(s)
+	if err := guard("disconnection", func() error {
+		s.server.disconnectEvent(s, reason)
+		return nil
+	}); err != nil {
+		s.reportError(err)
 	}
 }
 
+// startHeartbeat keeps sending heartbeats until the socket disconnects,
+// disconnecting it with protocol.CLOSE_TIMEOUT if the client goes silent
+// or as lost once heartbeats can no longer be sent.
 func (s *Socket) startHeartbeat() {
-	time.Sleep(time.Second * 2)
-	for {
-		if !s.connected {
-			break
-		}
-
-		// log.Println("sending heartbeat")
-		start := time.Now().UnixNano() / 1000000
-		raw(s, []byte{}, FRAME_TYPE_HEARTBEAT)
-		time.Sleep(time.Second * HEARTBEAT_INTERVAL)
-		if !s.connected {
-			break
-		}
-		if s.lastHeartbeatAck == 0 || s.lastHeartbeatAck-start > HEARTBEAT_INTERVAL*1000 {
-			// log.Println("disconnecting from server")
-			break
-		}
-		// log.Println("HEARTBEAT OK")
+	err := s.keepalive.Run(s.done, func(payload []byte) error {
+		return raw(s, payload, protocol.FRAME_TYPE_HEARTBEAT)
+	})
+	switch {
+	case err == nil:
+	case errors.Is(err, protocol.ErrHeartbeatTimeout):
+		s.disconnect(protocol.NewCloseReason(protocol.CLOSE_TIMEOUT, err.Error()))
+	case s.stalled.Load():
+		s.disconnect(protocol.NewCloseReason(protocol.CLOSE_WRITE_TIMEOUT, protocol.ErrWriteTimeout.Error()))
+	default:
+		s.disconnect(protocol.NewCloseReason(protocol.CLOSE_CONNECTION_LOST, err.Error()))
 	}
-	s.disconnect()
 }
 
 func (s *Server) handleConnection(conn net.Conn) {
 	// log.Printf("Accepted connection from %v\n", conn.RemoteAddr().String())
-	socket := s.addSocket(conn)
-	s.connectEvent(socket)
-	// go socket.startHeartbeat()
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), protocol.HANDSHAKE_TIMEOUT)
+		err := tlsConn.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			s.logger.Printf("TLS handshake with %v failed: %v\n", conn.RemoteAddr().String(), err)
+			conn.Close()
+			return
+		}
+	}
+
+	socket := s.newSocket(conn)
+	go socket.write()
+	if err := socket.acceptHandshake(); err != nil {
+		s.logger.Printf("Handshake with %v failed: %v\n", conn.RemoteAddr().String(), err)
+		socket.connected.Store(false)
+		socket.queue.Close()
+		conn.Close()
+		return
+	}
+	if s.authenticator != nil {
+		if err := socket.authenticate(); err != nil {
+			s.logger.Printf("Authentication of %v failed: %v\n", conn.RemoteAddr().String(), err)
+			socket.connected.Store(false)
+			socket.queue.Close()
+			conn.Close()
+			return
+		}
+	}
+	if !s.addSocket(socket) {
+		socket.connected.Store(false)
+		socket.queue.Close()
+		conn.Close()
+		return
+	}
+	socket.activity.Touch()
+	socket.decoder.IdleTimeout = s.idleTimeout
+	socket.decoder.ReadTimeout = s.readTimeout
+	go socket.startHeartbeat()
+	if err := guard("connection", func() error {
+		s.connectEvent(socket)
+		return nil
+	}); err != nil {
+		socket.reportError(err)
+	}
 	socket.listen()
 }
 
-func (s *Socket) listen() {
-	sockBuffer := bufio.NewReader(s.connection)
-
-	batchQueue := map[int][]byte{}
+func (s *Socket) acceptHandshake() error {
+	s.connection.SetReadDeadline(time.Now().Add(protocol.HANDSHAKE_TIMEOUT))
+	frame, err := s.decoder.Decode()
+	s.connection.SetReadDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+	if frame.Type != protocol.FRAME_TYPE_READY {
+		return s.refuse(fmt.Errorf("Expected handshake frame, got frame type %v", frame.Type))
+	}
 
-	for {
-		if !s.connected {
-			break
-		}
+	offer, err := protocol.DecodeHandshake(frame.Payload)
+	if err != nil {
+		return s.refuse(err)
+	}
 
-		// log.Println("(1) will read")
+	offered := protocol.NewHandshake(s.server.frameSize, s.server.heartbeatInterval, protocol.CompressorIds(s.server.compressors))
+	accepted, err := offered.Negotiate(offer)
+	if err != nil {
+		return s.refuse(err)
+	}
+	if s.server.authenticator == nil {
+		accepted.Features &^= protocol.FEATURE_AUTH
+	}
 
-		header := make([]byte, 6)
-		n, err := sockBuffer.Read(header)
-		if err != nil || n != 6 {
-			log.Println("err", err, n, header)
-			break // TODO: should be continue in production
-		}
+	s.handshake = accepted
+	s.encoder.FrameSize = int(accepted.MaxFrameSize)
+	s.decoder.MaxFrameSize = int(accepted.MaxFrameSize)
+	s.compression = protocol.NewCompression(accepted, s.server.compressors, s.server.minCompressSize, s.server.maxMessageSize)
+	s.transfers.Flow = accepted.Has(protocol.FEATURE_STREAM_FLOW)
+	s.keepalive = protocol.NewKeepalive(time.Duration(accepted.HeartbeatInterval)*time.Millisecond, s.server.maxMissedHeartbeats)
+	raw(s, accepted.Bytes(), protocol.FRAME_TYPE_READY)
+
+	// the client expects the answer before anything else, so it has to be
+	// on the wire before heartbeats or auth frames are queued
+	ctx, cancel := context.WithTimeout(context.Background(), protocol.HANDSHAKE_TIMEOUT)
+	defer cancel()
+	return s.queue.Flush(ctx)
+}
 
-		payloadLen := int(binary.BigEndian.Uint16(header[0:2]))
+// refuse tells the client why its handshake failed, waits briefly for that
+// to be written and returns err.
+func (s *Socket) refuse(err error) error {
+	s.flushClose(protocol.NewCloseReason(protocol.CLOSE_PROTOCOL_ERROR, err.Error()))
+	return err
+}
 
-		// log.Printf("(2) header: %v - payloadLen: %v", header, payloadLen)
+func (s *Socket) listen() {
+	s.disconnect(s.serve())
+}
 
-		payload := make([]byte, payloadLen)
-		n, err = io.ReadFull(sockBuffer, payload)
+// serve handles incoming frames until the connection ends and returns why
+// it did.
+func (s *Socket) serve() *protocol.CloseReason {
+	for {
+		if !s.connected.Load() {
+			return nil
+		}
 
-		// log.Println("(3) read", header, n)
+		frame, err := s.decoder.Decode()
+		if errors.Is(err, protocol.ErrMessageTooLarge) || errors.Is(err, protocol.ErrFrameTooLarge) || errors.Is(err, protocol.ErrBufferFull) {
+			return s.oversize(err)
+		}
+		if errors.Is(err, protocol.ErrIdleTimeout) {
+			return s.close(protocol.NewCloseReason(protocol.CLOSE_IDLE_TIMEOUT, err.Error()))
+		}
+		if errors.Is(err, protocol.ErrReadTimeout) {
+			return s.close(protocol.NewCloseReason(protocol.CLOSE_READ_TIMEOUT, err.Error()))
+		}
+		if err != nil && s.stalled.Load() {
+			return protocol.NewCloseReason(protocol.CLOSE_WRITE_TIMEOUT, protocol.ErrWriteTimeout.Error())
+		}
+		if err != nil {
+			return protocol.NewCloseReason(protocol.CLOSE_CONNECTION_LOST, err.Error())
+		}
+		s.keepalive.Seen()
 
-		if err != nil || n != payloadLen {
-			log.Println("err2", err, n, len(payload))
-			break // TODO: should be continue in production
+		if frame.Compressed() {
+			frame.Payload, err = s.compression.Decompress(frame.Payload)
+			if err == nil {
+				err = s.decoder.CheckEventSize(frame)
+			}
+			if errors.Is(err, protocol.ErrMessageTooLarge) {
+				return s.oversize(err)
+			}
+			if err != nil {
+				return s.fail(&protocol.ProtocolError{Err: err})
+			}
 		}
 
-		if !s.connected {
-			break
+		if !s.connected.Load() {
+			return nil
 		}
 
-		frameType := header[5]
-		msgSeq := int(binary.BigEndian.Uint16(header[2:4]))
-		isLast := header[4] == 2
-
-		// log.Printf("(4) frameType: %v - msgSeq: %v - pos: %v - payloadLen: %v", frameType, msgSeq, header[4], payloadLen)
-
-		batchQueue[msgSeq] = append(batchQueue[msgSeq], payload...)
-
-		if isLast {
-			switch frameType {
-			case byte(FRAME_TYPE_MESSAGE):
-				processMessageBatch(s, batchQueue[msgSeq], msgSeq)
-			case byte(FRAME_TYPE_HEARTBEAT):
-				log.Println("heartbeat in", time.Now().UnixNano()/1000000)
-				raw(s, []byte{}, FRAME_TYPE_HEARTBEAT_ACK)
-			case byte(FRAME_TYPE_HEARTBEAT_ACK):
-				s.lastHeartbeatAck = time.Now().UnixNano() / 1000000
-			default:
-				log.Fatalln("unknown frame type", frameType, payload)
+		switch frame.Type {
+		case protocol.FRAME_TYPE_MESSAGE:
+			err = processMessageFrame(s, frame.Payload)
+		case protocol.FRAME_TYPE_REQUEST:
+			err = processRequestFrame(s, frame.Payload)
+		case protocol.FRAME_TYPE_STREAM:
+			err = processStreamFrame(s, frame.Payload)
+		case protocol.FRAME_TYPE_RESPONSE:
+			var res *protocol.Response
+			if res, err = protocol.DecodeResponse(frame.Payload); err == nil {
+				s.pending.Resolve(res)
 			}
-
-			delete(batchQueue, msgSeq)
+		case protocol.FRAME_TYPE_HEARTBEAT:
+			if err = protocol.CheckHeartbeat(frame.Payload); err == nil {
+				ack(s, frame.Payload)
+			}
+		case protocol.FRAME_TYPE_HEARTBEAT_ACK:
+			s.keepalive.Ack(frame.Payload)
+		case protocol.FRAME_TYPE_READY:
+			s.server.logger.Println("ignoring repeated handshake from", s.Id)
+		case protocol.FRAME_TYPE_CLOSE:
+			var reason *protocol.CloseReason
+			if reason, err = protocol.DecodeCloseReason(frame.Payload); err == nil {
+				return reason
+			}
+		default:
+			err = fmt.Errorf("Unknown frame type %v", frame.Type)
+		}
+		if err != nil {
+			return s.fail(&protocol.ProtocolError{Err: err})
 		}
 	}
-	s.disconnect()
 }
 
-func processMessageBatch(s *Socket, batch []byte, msgSeq int) {
-	batchLen := len(batch)
-	if batchLen > 3 {
-		eventLen := binary.BigEndian.Uint16(batch[:2])
-		eventEnd := int(2 + eventLen)
-		if eventEnd > len(batch) {
-			log.Println(eventLen, eventEnd, batchLen, msgSeq, batch)
-		}
-		eventName := string(batch[2:eventEnd])
+func processMessageFrame(s *Socket, payload []byte) error {
+	msg, err := protocol.DecodeMessage(payload)
+	if err != nil {
+		return err
+	}
 
-		data := batch[eventEnd:]
+	s.dispatch(msg.Event, func() {
+		s.handleMessage(msg)
+	})
+	return nil
+}
 
-		go s.envokeEvent(eventName, string(data))
+func processRequestFrame(s *Socket, payload []byte) error {
+	id, msg, err := protocol.DecodeRequest(payload)
+	if err != nil {
+		return err
 	}
+
+	s.dispatch(msg.Event, func() {
+		s.envokeRequest(id, msg)
+	})
+	return nil
 }
 
-func emit(socket *Socket, event string, data []byte) error {
-	if !socket.connected {
-		return errors.New("Connection is already closed")
+func (s *Socket) envokeRequest(id uint32, msg *protocol.Message) {
+	var reply []byte
+	handled := false
+	err := guard(msg.Event, func() error {
+		return s.chain(func(socket *Socket, msg *protocol.Message) error {
+			handled = true
+
+			var err error
+			reply, err = socket.HandleRequest(msg)
+			return err
+		})(s, msg)
+	})
+	var panicErr *protocol.PanicError
+	if errors.As(err, &panicErr) {
+		s.reportError(err)
+		err = errors.New("Request handler for event " + msg.Event + " panicked")
 	}
-
-	if len(event) > 1<<16-2 {
-		return fmt.Errorf("Event Name length exceeds the maximum of %v bytes\n", 1<<16-2)
+	if err == nil && !handled {
+		err = errors.New("Request for event " + msg.Event + " was not handled")
 	}
 
-	headerBuff := []byte{0, 0, 0, 0}
-
-	payload := []byte{0, 0}
+	res := protocol.NewResponse(id, reply, err)
+	if err := compressed(s, res.Bytes(), protocol.FRAME_TYPE_RESPONSE); err != nil && !errors.Is(err, protocol.ErrConnectionClosed) {
+		s.reportError(fmt.Errorf("Couldn't reply to request for event %v: %w", msg.Event, err))
+	}
+}
 
-	eventBytes := []byte(event)
-	eventLen := len(eventBytes)
-	binary.BigEndian.PutUint16(payload, uint16(eventLen))
+func emit(socket *Socket, codecId byte, event string, data []byte) error {
+	if !socket.connected.Load() {
+		return protocol.ErrConnectionClosed
+	}
 
-	payload = append(payload, eventBytes...)
-	payload = append(payload, data...)
+	payload, err := protocol.EncodeMessage(codecId, event, data)
+	if err != nil {
+		return err
+	}
 
-	binary.BigEndian.PutUint32(headerBuff, uint32(len(payload)+1))
-	headerBuff = append(headerBuff, byte(FRAME_TYPE_MESSAGE))
+	return compressed(socket, payload, protocol.FRAME_TYPE_MESSAGE)
+}
 
-	frameBuff := []byte{}
-	frameBuff = append(frameBuff, headerBuff...)
-	frameBuff = append(frameBuff, payload...)
+// compressed is raw for payloads that are worth compressing, if the
+// handshake settled on a compressor.
+func compressed(socket *Socket, data []byte, frameType protocol.FrameType) error {
+	if !socket.connected.Load() {
+		return protocol.ErrConnectionClosed
+	}
 
-	time.Sleep(time.Microsecond * 500)
-	if _, err := socket.connection.Write(frameBuff); err != nil {
-		return fmt.Errorf("Error writing to underlying connection: %v", err)
+	data, flags, err := socket.compression.Compress(data)
+	if err != nil {
+		return err
 	}
-	return nil
+	seq, frames := socket.encoder.EncodeWithFlags(frameType, flags, data)
+	msg := &protocol.Outgoing{Seq: seq, Frames: frames}
+	if frameType == protocol.FRAME_TYPE_RESPONSE {
+		// dropping or refusing a response would leave the requester waiting
+		// until it times out
+		return socket.queue.PushBlocking(msg)
+	}
+	return socket.queue.Push(msg)
 }
 
-func buildFrame(data []byte, frameType FrameType) ([]byte, error) {
-	headerBuff := []byte{0, 0, 0, 0}
-
-	payload := []byte{}
-
-	payload = append(payload, data...)
-
-	binary.BigEndian.PutUint32(headerBuff, uint32(len(payload)+1))
-	headerBuff = append(headerBuff, byte(frameType))
+// raw queues a control frame, such as a heartbeat or a close frame, which
+// goes through whatever the overflow policy.
+func raw(socket *Socket, data []byte, frameType protocol.FrameType) error {
+	if !socket.connected.Load() {
+		return protocol.ErrConnectionClosed
+	}
 
-	frameBuff := []byte{}
-	frameBuff = append(frameBuff, headerBuff...)
-	frameBuff = append(frameBuff, payload...)
+	seq, frames := socket.encoder.Encode(frameType, data)
+	return socket.queue.PushControl(&protocol.Outgoing{Seq: seq, Frames: frames})
+}
 
-	return frameBuff, nil
+// ack answers a heartbeat unless the send queue is full. A client that
+// does not read its acknowledgements misses a latency sample instead of
+// growing the queue.
+func ack(socket *Socket, payload []byte) {
+	seq, frames := socket.encoder.Encode(protocol.FRAME_TYPE_HEARTBEAT_ACK, payload)
+	socket.queue.Offer(&protocol.Outgoing{Seq: seq, Frames: frames})
 }
 
-func raw(socket *Socket, data []byte, frameType FrameType) {
-	if !socket.connected {
-		return
-	}
-	frame, err := buildFrame(data, frameType)
-	if err != nil {
+// write drains the send queue. If a write fails it stops queueing but
+// leaves disconnecting to the reader, which may still find the client's
+// close frame on the connection, or to the next heartbeat. The
+// connection of a client that stopped reading is closed right away.
+func (s *Socket) write() {
+	err := s.queue.Run(&protocol.DeadlineWriter{Conn: s.connection, Timeout: s.server.writeTimeout})
+	if err == nil {
 		return
 	}
-	time.Sleep(time.Microsecond * 500)
 
-	if _, err = socket.connection.Write(frame); err != nil {
+	s.server.logger.Println("write err", err)
+	if errors.Is(err, protocol.ErrWriteTimeout) {
+		s.stalled.Store(true)
+		s.queue.Close()
+		s.connection.Close()
 		return
 	}
+	s.queue.Close()
 }
 
-func send(socket *Socket, event, data string) {
-	emit(socket, event, []byte(data))
+func send(socket *Socket, event, data string) error {
+	return emit(socket, codec.CODEC_RAW, event, []byte(data))
 }
 
-func New(address string) *Server {
-	return &Server{
-		address:         address,
-		listener:        nil,
-		sockets:         map[string]*Socket{},
-		connectEvent:    func(socket *Socket) {},
-		disconnectEvent: func(socket *Socket) {},
+// New creates a server that will listen on address, failing if address or
+// any of the options is invalid.
+func New(address string, options ...Option) (*Server, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("Invalid address %q: %v", address, err)
+	}
+
+	server := &Server{
+		address:             address,
+		listener:            nil,
+		sockets:             newRegistry(),
+		rooms:               map[string]map[string]*Socket{},
+		highWaterMark:       protocol.DEFAULT_HIGH_WATER_MARK,
+		overflowPolicy:      protocol.OVERFLOW_BLOCK,
+		codecs:              codec.NewRegistry(),
+		eventSizeLimits:     map[string]int{},
+		heartbeatInterval:   time.Second * HEARTBEAT_INTERVAL,
+		maxMissedHeartbeats: protocol.DEFAULT_MISSED_HEARTBEATS,
+		frameSize:           protocol.FRAME_SIZE,
+		requestTimeout:      protocol.DEFAULT_REQUEST_TIMEOUT,
+		maxMessageSize:      protocol.DEFAULT_MAX_MESSAGE_SIZE,
+		authTimeout:         AUTH_TIMEOUT,
+		logger:              log.Default(),
+		connectEvent:        func(socket *Socket) {},
+		disconnectEvent:     func(socket *Socket, reason *protocol.CloseReason) {},
+		errorEvent:          logError,
 	}
+	for _, option := range options {
+		if err := option(server); err != nil {
+			return nil, err
+		}
+	}
+	return server, nil
+}
+
+func NewTLS(address string, config *tls.Config, options ...Option) (*Server, error) {
+	return New(address, append([]Option{WithTLS(config)}, options...)...)
 }
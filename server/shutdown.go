@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	"go-sockets/protocol"
+)
+
+var ErrServerClosed = errors.New("Server closed")
+
+func (s *Server) shuttingDown() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.inShutdown
+}
+
+// track counts a handler as in flight so Shutdown can wait for it, unless
+// the server is shutting down. Every tracked handler must call
+// s.handlers.Done when it returns.
+func (s *Server) track() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.inShutdown {
+		return false
+	}
+	s.handlers.Add(1)
+	return true
+}
+
+// dispatch runs handler in its own goroutine unless the server is shutting
+// down. It reports whether handler was started.
+func (s *Server) dispatch(handler func()) bool {
+	if !s.track() {
+		return false
+	}
+
+	go func() {
+		defer s.handlers.Done()
+		handler()
+	}()
+	return true
+}
+
+// dispatch runs the handler for a message on event according to the
+// socket's dispatch mode, unless the server is shutting down.
+func (s *Socket) dispatch(event string, handler func()) {
+	if !s.server.track() {
+		return
+	}
+
+	s.dispatcher.Dispatch(event, func() {
+		defer s.server.handlers.Done()
+		handler()
+	})
+}
+
+// Shutdown stops accepting connections and sends a goodbye frame to every
+// connected socket. It then waits for in-flight handlers to finish, or for
+// ctx to be done, and for their replies to be written before disconnecting
+// the sockets, which fires OnDisconnection for each of them. Listen returns
+// ErrServerClosed once Shutdown has been called.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	s.inShutdown = true
+	listener := s.listener
+	s.mutex.Unlock()
+
+	if listener != nil {
+		listener.Close()
+	}
+
+	reason := protocol.NewCloseReason(protocol.CLOSE_SHUTDOWN, "")
+	sockets := s.sockets.snapshot()
+	for _, socket := range sockets {
+		raw(socket, reason.Bytes(), protocol.FRAME_TYPE_CLOSE)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	for _, socket := range sockets {
+		if err == nil {
+			err = socket.queue.Flush(ctx)
+		}
+		socket.disconnect(reason)
+	}
+	return err
+}
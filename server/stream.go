@@ -0,0 +1,65 @@
+package server
+
+import (
+	"io"
+
+	"go-sockets/protocol"
+)
+
+type StreamHandler = protocol.StreamHandler
+
+// OpenStream starts a stream on event. Everything written is sent in
+// chunks without buffering the whole payload; writes block while the send
+// queue is full regardless of the overflow policy, and while the client's
+// handler has protocol.STREAM_WINDOW bytes left to read. Close finishes the
+// stream; the writer is a *protocol.StreamWriter whose CloseWithError
+// aborts it instead. Writes fail with protocol.ErrStreamCanceled once the
+// client stops reading the stream.
+func (s *Socket) OpenStream(event string) (io.WriteCloser, error) {
+	if !s.connected.Load() {
+		return nil, protocol.ErrConnectionClosed
+	}
+
+	return s.transfers.Open(event, s.encoder.MaxPayload(), func(payload []byte) error {
+		if !s.connected.Load() {
+			return protocol.ErrConnectionClosed
+		}
+		seq, frames := s.encoder.Encode(protocol.FRAME_TYPE_STREAM, payload)
+		return s.queue.PushBlocking(&protocol.Outgoing{Seq: seq, Frames: frames})
+	})
+}
+
+func processStreamFrame(s *Socket, payload []byte) error {
+	frame, err := protocol.DecodeStreamFrame(payload)
+	if err != nil {
+		return err
+	}
+
+	if frame.Kind != protocol.STREAM_OPEN {
+		// waiting for a handler to catch up is not the client going silent
+		defer s.keepalive.Hold()()
+		return s.transfers.Feed(frame)
+	}
+
+	handler, ok := s.StreamHandlerFor(string(frame.Data))
+	if !ok {
+		s.transfers.Refuse(frame.Id)
+		return nil
+	}
+
+	reader := s.transfers.Accept(frame.Id)
+	event := string(frame.Data)
+	started := s.server.dispatch(func() {
+		defer reader.Close()
+		if err := guard(event, func() error {
+			handler(reader)
+			return nil
+		}); err != nil {
+			s.reportError(err)
+		}
+	})
+	if !started {
+		reader.Close()
+	}
+	return nil
+}